@@ -0,0 +1,188 @@
+package catalog
+
+import (
+	"chrome_render/config"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// States of a catalog entry.
+const (
+	StateFinished     = "finished"
+	StateUploaded     = "uploaded"
+	StateUploadFailed = "upload-failed"
+	StateRecovered    = "recovered"
+)
+
+var conf = config.GetConfig()
+
+var ErrNotFound = errors.New("recording not found")
+
+// Recording is one recorded segment file, or a clip cut out of the
+// segments listed in ClipOf.
+type Recording struct {
+	Id        string    `json:"id"`
+	TaskName  string    `json:"taskName"`
+	Url       string    `json:"url"`
+	SessionId string    `json:"sessionId"`
+	Segment   int       `json:"segment"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	Duration  float64   `json:"duration"`
+	Size      int64     `json:"size"`
+	Codecs    []string  `json:"codecs"`
+	Sha256    string    `json:"sha256"`
+	Path      string    `json:"path"`
+	Location  string    `json:"location"`
+	State     string    `json:"state"`
+	ClipOf    []string  `json:"clipOf,omitempty"`
+
+	Thumbnails string   `json:"thumbnails,omitempty"`
+	Sprites    []string `json:"sprites,omitempty"`
+}
+
+// Filter selects entries in List, empty fields match everything.
+type Filter struct {
+	TaskName string
+	From     time.Time
+	To       time.Time
+}
+
+var (
+	lock     sync.Mutex
+	loadOnce sync.Once
+	entries  = map[string]*Recording{}
+)
+
+// load reads the catalog file once; a missing file is an empty catalog.
+func load() {
+	loadOnce.Do(func() {
+		data, err := ioutil.ReadFile(*conf.CatalogPath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logrus.WithError(err).Errorf("read catalog %s failed", *conf.CatalogPath)
+			}
+			return
+		}
+
+		var list []*Recording
+		if err := json.Unmarshal(data, &list); err != nil {
+			logrus.WithError(err).Errorf("parse catalog %s failed", *conf.CatalogPath)
+			return
+		}
+		for _, rec := range list {
+			entries[rec.Id] = rec
+		}
+		logrus.Printf("catalog loaded %d recordings from %s", len(list), *conf.CatalogPath)
+	})
+}
+
+// save writes the whole catalog to a temp file and renames it over the old
+// one, so a crash never leaves a half written catalog.
+func save() error {
+	list := make([]*Recording, 0, len(entries))
+	for _, rec := range entries {
+		list = append(list, rec)
+	}
+	sortByStart(list)
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := *conf.CatalogPath
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func sortByStart(list []*Recording) {
+	sort.Slice(list, func(a, b int) bool {
+		if list[a].StartTime.Equal(list[b].StartTime) {
+			return list[a].Id < list[b].Id
+		}
+		return list[a].StartTime.Before(list[b].StartTime)
+	})
+}
+
+// Add stores a new entry, replacing one with the same id.
+func Add(rec *Recording) error {
+	load()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := *rec
+	entries[rec.Id] = &entry
+	return save()
+}
+
+// Update changes an entry in place and saves the catalog.
+func Update(id string, fn func(rec *Recording)) error {
+	load()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	rec, ok := entries[id]
+	if !ok {
+		return ErrNotFound
+	}
+	fn(rec)
+	return save()
+}
+
+// Get returns a copy of the entry.
+func Get(id string) (*Recording, bool) {
+	load()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	rec, ok := entries[id]
+	if !ok {
+		return nil, false
+	}
+	entry := *rec
+	return &entry, true
+}
+
+// List returns copies of the matching entries ordered by start time.
+func List(filter Filter) []*Recording {
+	load()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	list := make([]*Recording, 0, len(entries))
+	for _, rec := range entries {
+		if filter.TaskName != "" && rec.TaskName != filter.TaskName {
+			continue
+		}
+		if !filter.From.IsZero() && rec.EndTime.Before(filter.From) {
+			continue
+		}
+		if !filter.To.IsZero() && rec.StartTime.After(filter.To) {
+			continue
+		}
+		entry := *rec
+		list = append(list, &entry)
+	}
+
+	sortByStart(list)
+	return list
+}
@@ -0,0 +1,256 @@
+package cgroup
+
+import (
+	"bufio"
+	"chrome_render/config"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// cpuPeriod is the cpu.max period, the quota is a share of it.
+const cpuPeriod = 100000
+
+// serviceGroup is the leaf the service moves itself into when it runs in a
+// cgroup it has to enable controllers in, cgroup v2 allows no process in a
+// group whose children have controllers.
+const serviceGroup = "_service"
+
+var conf = config.GetConfig()
+
+var (
+	groupSeq    int64
+	invalidName = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+)
+
+// Group is the cgroup v2 of one task, its processes share the cpu quota
+// and memory limit.
+type Group struct {
+	Path string
+}
+
+// Usage is read back from the cgroup files.
+type Usage struct {
+	CpuUsec      uint64    `json:"cpuUsec"`
+	MemoryBytes  uint64    `json:"memoryBytes"`
+	MemoryPeak   uint64    `json:"memoryPeak,omitempty"`
+	MemoryMax    uint64    `json:"memoryMax,omitempty"`
+	OOMKills     uint64    `json:"oomKills"`
+	CpuThrottled uint64    `json:"cpuThrottledUsec"`
+	ProcessCount int       `json:"processCount"`
+	ReadTime     time.Time `json:"readTime"`
+}
+
+// Enabled reports whether tasks run in their own cgroup.
+func Enabled() bool {
+	return *conf.CgroupRoot != ""
+}
+
+// Create makes the cgroup of the task with the configured limits, enabling
+// the cpu and memory controllers on the way down from the parent. The root
+// and its parent must be delegated to the service and hold no process but
+// the service's own, which moves to a leaf of its group.
+func Create(taskName string) (*Group, error) {
+	root := *conf.CgroupRoot
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{filepath.Dir(root), root} {
+		if err := enableControllers(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	name := fmt.Sprintf("%s_%d", invalidName.ReplaceAllString(taskName, "_"), atomic.AddInt64(&groupSeq, 1))
+	g := &Group{Path: filepath.Join(root, name)}
+	if err := os.Mkdir(g.Path, 0755); err != nil {
+		return nil, err
+	}
+
+	if *conf.TaskCpu > 0 {
+		quota := *conf.TaskCpu * cpuPeriod / 100
+		if err := g.write("cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)); err != nil {
+			g.Remove()
+			return nil, err
+		}
+	}
+	if *conf.TaskMemory > 0 {
+		if err := g.write("memory.max", strconv.FormatInt(int64(*conf.TaskMemory)<<20, 10)); err != nil {
+			g.Remove()
+			return nil, err
+		}
+	}
+
+	logrus.Printf("cgroup %s created, cpu: %d%%, memory: %d MB. task name: %s", g.Path, *conf.TaskCpu, *conf.TaskMemory, taskName)
+	return g, nil
+}
+
+// Add moves the processes into the cgroup, their later children start in it.
+func (g *Group) Add(pids ...int) error {
+	for _, pid := range pids {
+		if err := g.write("cgroup.procs", strconv.Itoa(pid)); err != nil && !os.IsNotExist(err) {
+			// the process may have exited meanwhile
+			if _, statErr := os.Stat(fmt.Sprintf("/proc/%d", pid)); statErr == nil {
+				return fmt.Errorf("add process %d to cgroup %s: %w", pid, g.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Usage reads the cpu and memory accounting of the cgroup.
+func (g *Group) Usage() (*Usage, error) {
+	cpu, err := g.readKeyed("cpu.stat")
+	if err != nil {
+		return nil, err
+	}
+	events, err := g.readKeyed("memory.events")
+	if err != nil {
+		return nil, err
+	}
+
+	u := &Usage{
+		CpuUsec:      cpu["usage_usec"],
+		CpuThrottled: cpu["throttled_usec"],
+		OOMKills:     events["oom_kill"],
+		ReadTime:     time.Now(),
+	}
+	u.MemoryBytes, _ = g.readUint("memory.current")
+	u.MemoryPeak, _ = g.readUint("memory.peak")
+	u.MemoryMax, _ = g.readUint("memory.max")
+	if data, err := ioutil.ReadFile(filepath.Join(g.Path, "cgroup.procs")); err == nil {
+		u.ProcessCount = len(strings.Fields(string(data)))
+	}
+	return u, nil
+}
+
+// Remove deletes the cgroup once its processes are gone.
+func (g *Group) Remove() {
+	var err error
+	for n := 0; n < 10; n++ {
+		if err = os.Remove(g.Path); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	logrus.WithError(err).Errorf("remove cgroup %s failed", g.Path)
+}
+
+// Cleanup removes the empty cgroups left by a previous run.
+func Cleanup() {
+	if !Enabled() {
+		return
+	}
+
+	dirs, err := ioutil.ReadDir(*conf.CgroupRoot)
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || dir.Name() == serviceGroup {
+			continue
+		}
+		path := filepath.Join(*conf.CgroupRoot, dir.Name())
+		if err := os.Remove(path); err != nil {
+			logrus.WithError(err).Warnf("remove cgroup %s left by a previous run failed", path)
+		}
+	}
+}
+
+func enableControllers(dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		return fmt.Errorf("cgroup v2 not found at %s: %w", dir, err)
+	}
+
+	enabled := map[string]bool{}
+	for _, c := range strings.Fields(string(data)) {
+		enabled[c] = true
+	}
+	for _, c := range []string{"cpu", "memory"} {
+		if enabled[c] {
+			continue
+		}
+		err := ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+"+c), 0644)
+		if errors.Is(err, syscall.EBUSY) && leaveGroup(dir) {
+			err = ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+"+c), 0644)
+		}
+		if err != nil {
+			return fmt.Errorf("enable %s controller in %s, it must hold no process: %w", c, dir, err)
+		}
+	}
+	return nil
+}
+
+// leaveGroup moves the service out of dir into a leaf of its own, it
+// returns false when the service is not in dir or can't move.
+func leaveGroup(dir string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return false
+	}
+	pid := strconv.Itoa(os.Getpid())
+	found := false
+	for _, p := range strings.Fields(string(data)) {
+		found = found || p == pid
+	}
+	if !found {
+		return false
+	}
+
+	leaf := filepath.Join(dir, serviceGroup)
+	if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+		logrus.WithError(err).Warnf("create service cgroup %s failed", leaf)
+		return false
+	}
+	if err := ioutil.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(pid), 0644); err != nil {
+		logrus.WithError(err).Warnf("move service to cgroup %s failed", leaf)
+		return false
+	}
+	logrus.Printf("service moved to cgroup %s, %s can enable controllers", leaf, dir)
+	return true
+}
+
+func (g *Group) write(file, value string) error {
+	return ioutil.WriteFile(filepath.Join(g.Path, file), []byte(value), 0644)
+}
+
+func (g *Group) readUint(file string) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(g.Path, file))
+	if err != nil {
+		return 0, err
+	}
+	// memory.max reads "max" without a limit
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readKeyed parses the "key value" lines of files like cpu.stat.
+func (g *Group) readKeyed(file string) (map[string]uint64, error) {
+	f, err := os.Open(filepath.Join(g.Path, file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = v
+		}
+	}
+	return values, scanner.Err()
+}
@@ -0,0 +1,40 @@
+package cgroup
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// joinScript moves the shell into the cgroup.procs file given as $0 and
+// execs the program, which keeps the pid of the shell.
+const joinScript = `echo $$ > "$0" || echo "join cgroup $0 failed" >&2; exec "$@"`
+
+// Command returns the command running name inside the group, so the process
+// and its children start in it instead of being moved there once running.
+// A nil group runs name as it is.
+func (g *Group) Command(name string, args ...string) *exec.Cmd {
+	if g == nil {
+		return exec.Command(name, args...)
+	}
+	return exec.Command("/bin/sh", append([]string{"-c", joinScript, g.procs(), name}, args...)...)
+}
+
+// WriteLauncher writes an executable script at path running name inside the
+// group with the arguments it is given, for programs started by a library
+// which only takes the path of a binary.
+func (g *Group) WriteLauncher(path, name string) error {
+	script := "#!/bin/sh\n" +
+		"echo $$ > " + quote(g.procs()) + ` || echo "join cgroup failed" >&2` + "\n" +
+		"exec " + quote(name) + ` "$@"` + "\n"
+	return ioutil.WriteFile(path, []byte(script), 0755)
+}
+
+func (g *Group) procs() string {
+	return filepath.Join(g.Path, "cgroup.procs")
+}
+
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,175 @@
+package chrome
+
+import (
+	"chrome_render/cgroup"
+	"chrome_render/wsserver"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"sync"
+)
+
+const encoderQueueSize = 32
+
+// encoder turns the screencast frames of a task, and the audio of its sink
+// when it has one, into a webm recorded like the stream of the extension.
+type encoder struct {
+	lock sync.Mutex
+
+	taskName string
+	cmd      *exec.Cmd
+	chFrames chan []byte
+	closed   bool
+	exited   chan struct{}
+}
+
+// startEncoder runs ffmpeg reading jpegs from stdin and the monitor source
+// of the sink, an empty monitor encodes the video only.
+func startEncoder(taskName, monitor string, group *cgroup.Group) (*encoder, error) {
+	path, err := exec.LookPath(*conf.FfmpegPath)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"-hide_banner", "-loglevel", "error",
+		"-f", "image2pipe", "-use_wallclock_as_timestamps", "1", "-c:v", "mjpeg", "-i", "pipe:0"}
+	if monitor != "" {
+		args = append(args, "-f", "pulse", "-i", monitor, "-map", "0:v", "-map", "1:a", "-c:a", "libopus")
+	}
+	args = append(args, "-c:v", "libvpx", "-deadline", "realtime", "-cpu-used", "8", "-b:v", "2M",
+		"-vsync", "vfr", "-f", "webm", "-live", "1", "pipe:1")
+
+	cmd := group.Command(path, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	e := &encoder{
+		taskName: taskName,
+		cmd:      cmd,
+		chFrames: make(chan []byte, encoderQueueSize),
+		exited:   make(chan struct{}),
+	}
+	go e.writeLoop(stdin, e.chFrames)
+	go e.readLoop(stdout)
+
+	logrus.Printf("screencast encoder started, audio: %q. task name: %s", monitor, taskName)
+	return e, nil
+}
+
+// write queues a frame, dropping it when ffmpeg falls behind.
+func (e *encoder) write(jpg []byte) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.closed {
+		return
+	}
+	select {
+	case e.chFrames <- jpg:
+	default:
+		logrus.Debugf("screencast encoder queue is full. task name: %s", e.taskName)
+	}
+}
+
+// close ends the input of ffmpeg and waits for the recording to be written.
+func (e *encoder) close() {
+	e.lock.Lock()
+	if e.closed {
+		e.lock.Unlock()
+		return
+	}
+	e.closed = true
+	close(e.chFrames)
+	e.lock.Unlock()
+
+	<-e.exited
+}
+
+// startScreencastEncoder starts recording the frames of a screencast task,
+// with the audio of its sink.
+func (i *chromeInstance) startScreencastEncoder() error {
+	monitor := ""
+	if i.sink != nil {
+		monitor = i.sink.Monitor()
+	}
+	enc, err := startEncoder(i.taskName, monitor, i.cgroup)
+	if err != nil {
+		return err
+	}
+
+	i.statusLock.Lock()
+	prev := i.encoder
+	i.encoder = enc
+	i.statusLock.Unlock()
+	if prev != nil {
+		prev.close()
+	}
+	return nil
+}
+
+// stopScreencastEncoder closes the recording of a screencast task.
+func (i *chromeInstance) stopScreencastEncoder() {
+	i.statusLock.Lock()
+	enc := i.encoder
+	i.encoder = nil
+	i.statusLock.Unlock()
+	if enc != nil {
+		enc.close()
+	}
+}
+
+// onEncoderCommand runs the recorder actions, e.g. of the disk guard, on the
+// screencast encoder. ffmpeg can't pause, so the recording is closed and a
+// new one is started on resume.
+func (i *chromeInstance) onEncoderCommand(action string) error {
+	switch action {
+	case wsserver.ActionStop, wsserver.ActionPause:
+		logrus.Printf("screencast encoder stopped by %s. task name: %s", action, i.taskName)
+		i.stopScreencastEncoder()
+		return nil
+	case wsserver.ActionStart, wsserver.ActionResume:
+		if s := i.state(); s.encoder != nil || s.done || s.idle {
+			return nil
+		}
+		logrus.Printf("screencast encoder restarted by %s. task name: %s", action, i.taskName)
+		return i.startScreencastEncoder()
+	default:
+		return fmt.Errorf("screencast encoder can't %s", action)
+	}
+}
+
+func (e *encoder) writeLoop(w io.WriteCloser, chFrames chan []byte) {
+	defer w.Close()
+
+	for jpg := range chFrames {
+		if _, err := w.Write(jpg); err != nil {
+			logrus.WithError(err).Warnf("write screencast encoder failed. task name: %s", e.taskName)
+			for range chFrames {
+			}
+			return
+		}
+	}
+}
+
+func (e *encoder) readLoop(r io.Reader) {
+	defer close(e.exited)
+
+	if err := wsserver.Ingest(e.taskName, r); err != nil {
+		logrus.WithError(err).Errorf("record screencast failed. task name: %s", e.taskName)
+	}
+	io.Copy(ioutil.Discard, r)
+	if err := e.cmd.Wait(); err != nil {
+		logrus.WithError(err).Warnf("screencast encoder exited. task name: %s", e.taskName)
+	}
+}
@@ -0,0 +1,131 @@
+package chrome
+
+import (
+	"chrome_render/crx"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// ingestUrl is the websocket server the extension streams to, on the
+// loopback when the server listens on every interface.
+func ingestUrl() string {
+	host, port, err := net.SplitHostPort(*conf.IngestAddr)
+	if err != nil {
+		return "ws://" + *conf.IngestAddr
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return "ws://" + net.JoinHostPort(host, port)
+}
+
+// extensionSource returns the files of the recorder extension, embedded or
+// from the configured directory.
+func extensionSource() (fs.FS, error) {
+	if *conf.EmbeddedExtension {
+		return crx.Files, nil
+	}
+
+	dir := *conf.ExtensionPath
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(getCurrentDirectory(), dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err != nil {
+		return nil, fmt.Errorf("no extension in %s: %w", dir, err)
+	}
+	return os.DirFS(dir), nil
+}
+
+// prepareExtension copies the extension to a directory of the task, with a
+// task.js telling it which task it records for.
+func (i *chromeInstance) prepareExtension() error {
+	src, err := extensionSource()
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "chrome_render_crx_")
+	if err != nil {
+		return err
+	}
+
+	err = copyTree(src, dir)
+	if err == nil {
+		err = writeTaskJS(filepath.Join(dir, "js", "task.js"), i.extensionTask())
+	}
+	if err == nil {
+		i.extensionID, err = extensionID(src, dir)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	i.extensionDir = dir
+	return nil
+}
+
+// extensionTask is the task the extension records for, none while the
+// browser waits in the pool.
+func (i *chromeInstance) extensionTask() string {
+	if i.idle {
+		return ""
+	}
+	return i.taskName
+}
+
+func writeTaskJS(path, taskName string) error {
+	name, err := json.Marshal(taskName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	js := fmt.Sprintf("// Written by the launcher for this task.\nconst TASK_NAME = %s;\nconst INGEST_URL = %q;\n", name, ingestUrl())
+	return ioutil.WriteFile(path, []byte(js), 0644)
+}
+
+// extensionID computes the id chrome gives the extension: the first 128 bits
+// of the sha256 of the public key in the manifest, or of the directory path
+// without a key, written as hex digits shifted to a-p.
+func extensionID(src fs.FS, dir string) (string, error) {
+	data, err := fs.ReadFile(src, "manifest.json")
+	if err != nil {
+		return "", err
+	}
+
+	var manifest struct {
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return "", fmt.Errorf("parse extension manifest: %w", err)
+	}
+
+	input := []byte(dir)
+	if manifest.Key != "" {
+		if input, err = base64.StdEncoding.DecodeString(manifest.Key); err != nil {
+			return "", fmt.Errorf("decode extension key: %w", err)
+		}
+	}
+
+	sum := sha256.Sum256(input)
+	id := []byte(hex.EncodeToString(sum[:16]))
+	for n, c := range id {
+		if c >= 'a' {
+			id[n] = c - 'a' + 'k'
+		} else {
+			id[n] = c - '0' + 'a'
+		}
+	}
+	return string(id), nil
+}
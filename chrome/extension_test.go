@@ -0,0 +1,38 @@
+package chrome
+
+import (
+	"chrome_render/crx"
+	"testing"
+	"testing/fstest"
+)
+
+func TestExtensionID(t *testing.T) {
+	// the id chrome shows for the bundled extension, from the key in its
+	// manifest
+	id, err := extensionID(crx.Files, "/tmp/chrome_render_crx_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "cmcfmlmdhmgicnllocpakgjdgenneoed"; id != want {
+		t.Errorf("bundled extension id %s, want %s", id, want)
+	}
+	if other, _ := extensionID(crx.Files, "/tmp/chrome_render_crx_2"); other != id {
+		t.Errorf("id %s changes with the directory, want %s", other, id)
+	}
+
+	// without a key chrome derives the id from the directory
+	unpacked := fstest.MapFS{"manifest.json": {Data: []byte(`{"name": "unpacked"}`)}}
+	first, err := extensionID(unpacked, "/tmp/chrome_render_crx_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := extensionID(unpacked, "/tmp/chrome_render_crx_2")
+	if first == second || len(first) != 32 {
+		t.Errorf("unpacked extension ids %s and %s", first, second)
+	}
+	for _, c := range first {
+		if c < 'a' || c > 'p' {
+			t.Fatalf("id %s has a character out of a-p", first)
+		}
+	}
+}
@@ -1,15 +1,25 @@
 package chrome
 
 import (
+	"chrome_render/cgroup"
 	"chrome_render/config"
+	"chrome_render/overlay"
+	"chrome_render/pulse"
+	"chrome_render/quota"
+	"chrome_render/storage"
+	"chrome_render/thumbnail"
+	"chrome_render/wsserver"
+	"chrome_render/xvfb"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/chromedp/cdproto"
+	"github.com/chromedp/cdproto/cdp"
 	"github.com/chromedp/cdproto/emulation"
 	"github.com/chromedp/cdproto/page"
 	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/cdproto/target"
 	"github.com/chromedp/chromedp"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
@@ -17,6 +27,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -47,6 +58,42 @@ type chromeInstance struct {
 
 	isDoneFlag bool
 	pid        int
+	pgid       int
+	run        ChromeRunCallBack
+
+	recordErr error
+	startTime time.Time
+
+	overlay       []OverlayElement
+	overlayScript page.ScriptIdentifier
+
+	mode    string
+	display *xvfb.Display
+	sink    *pulse.Sink
+	encoder *encoder
+
+	extensionDir string
+	extensionID  string
+	extensionCtx context.Context
+
+	profileDir  string
+	keepProfile bool
+
+	options ChromeOptions
+
+	cgroup      *cgroup.Group
+	stopWatch   chan struct{}
+	usage       *cgroup.Usage
+	statusLock  sync.Mutex
+	releaseOnce sync.Once
+
+	cancel   context.CancelFunc
+	poolName string
+	idle     bool
+	uses     int
+
+	targetID         target.ID
+	browserContextID cdp.BrowserContextID
 }
 
 type ChromeRunCallBack struct {
@@ -59,15 +106,96 @@ func (i *chromeInstance) Description() string {
 }
 
 func (i *chromeInstance) isDone() bool {
+	i.statusLock.Lock()
+	defer i.statusLock.Unlock()
+
 	return i.isDoneFlag
 }
 
+// taskState is the task of the browser as the event handlers see it, they
+// run while a pooled browser is handed over to another task.
+type taskState struct {
+	taskName       string
+	url            string
+	chanPageFrames chan<- *PageScreencastFrameImage
+	overlay        []OverlayElement
+	encoder        *encoder
+	idle           bool
+	done           bool
+}
+
+// state returns the current task of the browser, the fields it holds are
+// only changed under statusLock.
+func (i *chromeInstance) state() taskState {
+	i.statusLock.Lock()
+	defer i.statusLock.Unlock()
+
+	return taskState{
+		taskName:       i.taskName,
+		url:            i.url,
+		chanPageFrames: i.chanPageFrames,
+		overlay:        i.overlay,
+		encoder:        i.encoder,
+		idle:           i.idle,
+		done:           i.isDoneFlag,
+	}
+}
+
 func (i *chromeInstance) Start(parent context.Context) error {
-	if err:=os.Setenv("DISPLAY", ":2"); err != nil {
-		panic(err)
+	err := i.start(parent)
+	i.statusLock.Lock()
+	i.run = ChromeRunCallBack{PID: i.pid, Err: err}
+	i.statusLock.Unlock()
+	if err == nil {
+		go i.watchCgroup()
+	}
+	return err
+}
+
+func (i *chromeInstance) start(parent context.Context) error {
+	if err := i.options.validate(); err != nil {
+		logrus.WithError(err).Errorf("invalid chrome options. task name: %s", i.taskName)
+		return err
+	}
+
+	if i.mode == ModeShared {
+		return i.startShared()
+	}
+
+	i.createCgroup()
+
+	var err error
+	if !i.screencastOnly() {
+		if i.display, err = xvfb.Start(i.widthSize, i.heightSize, i.cgroup); err != nil {
+			logrus.WithError(err).Errorf("start display failed. task name: %s", i.taskName)
+			return err
+		}
+		if err = i.prepareExtension(); err != nil {
+			logrus.WithError(err).Errorf("prepare extension failed. task name: %s", i.taskName)
+			i.release()
+			return err
+		}
+	}
+
+	if pulse.Enabled() {
+		if i.sink, err = pulse.Load(i.taskName); err != nil {
+			logrus.WithError(err).Warnf("no audio sink, chrome plays to the default one. task name: %s", i.taskName)
+		}
 	}
 
-	ctx, _ := chromedp.NewExecAllocator(parent, i.DefaultOptions()...)
+	// an idle pooled browser gets its task when it is claimed
+	if !i.idle {
+		i.bindTask()
+	}
+
+	if err = i.prepareProfile(); err != nil {
+		logrus.WithError(err).Errorf("create chrome profile failed. task name: %s", i.taskName)
+		i.release()
+		return err
+	}
+
+	ctx, cancel := chromedp.NewExecAllocator(parent, i.DefaultOptions()...)
+	i.cancel = cancel
 	//go func() {
 	//	select {
 	//	case <-parent.done():
@@ -80,45 +208,130 @@ func (i *chromeInstance) Start(parent context.Context) error {
 		chromedp.WithErrorf(i.devToolHandler),
 		chromedp.WithLogf(i.devToolHandler))
 	//defer cancel()
+	i.startCtx = ctx
 
-	err := chromedp.Run(ctx, i.makeTasks())
+	err = chromedp.Run(ctx, i.makeTasks())
 	if err != nil {
 		logrus.WithError(err).Errorf("chromedp run tasks error. task name: %s", i.taskName)
+		i.trackBrowser()
+		i.release()
 		return err
 	}
 
+	i.trackBrowser()
 	return nil
 }
 
+// bindTask registers the task with the recording server and starts the
+// encoder of a screencast task.
+func (i *chromeInstance) bindTask() {
+	if !i.screencastOnly() {
+		wsserver.SetTaskUrl(i.taskName, i.url)
+		wsserver.SetCaptureOptions(i.taskName, i.captureOptions())
+		wsserver.SetEventHandler(i.taskName, i.onRecordEvent)
+		return
+	}
+
+	if *conf.ScreencastEncode {
+		if err := i.startScreencastEncoder(); err != nil {
+			logrus.WithError(err).Errorf("start screencast encoder failed. task name: %s", i.taskName)
+			return
+		}
+		wsserver.SetTaskUrl(i.taskName, i.url)
+		wsserver.SetEventHandler(i.taskName, i.onRecordEvent)
+		wsserver.SetCommandHandler(i.taskName, i.onEncoderCommand)
+	}
+}
+
+// unbindTask undoes bindTask when a pooled browser goes back to the pool.
+func (i *chromeInstance) unbindTask() {
+	wsserver.SetEventHandler(i.taskName, nil)
+	wsserver.SetCommandHandler(i.taskName, nil)
+	wsserver.SetTaskUrl(i.taskName, "")
+	wsserver.ClearCaptureOptions(i.taskName)
+	i.stopScreencastEncoder()
+}
+
 func (i *chromeInstance) done() {
+	i.statusLock.Lock()
 	i.isDoneFlag = true
+	i.statusLock.Unlock()
+	finishTask(i)
+	if i.pooled() && pool.put(i) {
+		return
+	}
+	i.release()
+}
+
+// release stops the chrome process and what was started for it, once
+// whether the task is done or failed.
+func (i *chromeInstance) release() {
+	i.releaseOnce.Do(i.releaseAll)
+}
+
+func (i *chromeInstance) releaseAll() {
+	if i.stopWatch != nil {
+		close(i.stopWatch)
+	}
+	if i.cancel != nil {
+		i.cancel()
+	}
+	i.killBrowser()
+	if i.targetID != "" {
+		shared.closeTab(i)
+	}
+	if enc := i.state().encoder; enc != nil {
+		enc.close()
+	}
+	if i.sink != nil {
+		i.sink.Unload()
+	}
+	if i.display != nil {
+		i.display.Stop()
+	}
+	if i.extensionDir != "" {
+		os.RemoveAll(i.extensionDir)
+	}
+	i.removeProfile()
+	if i.cgroup != nil {
+		i.cgroup.Remove()
+	}
 }
 
 func (i *chromeInstance) onPageLoadFired() {
 	go func() {
+		s := i.state()
 		if i.actionFunCtx == nil {
-			logrus.Warnf("%s actionFunCtx is Null, re-try after 100 Millisecond. task name: %s", i.url, i.taskName)
+			logrus.Warnf("%s actionFunCtx is Null, re-try after 100 Millisecond. task name: %s", s.url, s.taskName)
 			time.Sleep(time.Millisecond * 100)
 			i.onPageLoadFired()
 			return
 		}
 
 		var res = -1
-		ctx, _ := context.WithCancel(i.actionFunCtx)
+		ctx, cancel := context.WithCancel(i.actionFunCtx)
+		defer cancel()
 
-		if err := chromedp.Evaluate(injectJSCodes(i.url), &res).Do(ctx); err != nil {
-			logrus.WithError(err).Errorf("injectAudio on reloaded failed. task name: %s", i.taskName)
-			return
+		// the silent audio only keeps the audio track of the tab capture
+		if !i.screencastOnly() {
+			if err := chromedp.Evaluate(injectJSCodes(s.url), &res).Do(ctx); err != nil {
+				logrus.WithError(err).Errorf("injectAudio on reloaded failed. task name: %s", s.taskName)
+				return
+			}
+		}
+		if err := i.injectOverlay(ctx, s.overlay); err != nil {
+			logrus.WithError(err).Errorf("inject overlay on reloaded failed. task name: %s", s.taskName)
 		}
 
-		logrus.Printf("%s page onPageLoadFired. task name: %s", i.url, i.taskName)
+		logrus.Printf("%s page onPageLoadFired. task name: %s", s.url, s.taskName)
 	}()
 }
 
 func (i *chromeInstance) makeTasks() chromedp.Tasks {
 	//var res int
-	return chromedp.Tasks{
+	tasks := chromedp.Tasks{
 		emulation.SetDeviceMetricsOverride(int64(i.widthSize), int64(i.heightSize), 1.0, false),
+		chromedp.ActionFunc(i.registerOverlay),
 		chromedp.Navigate(i.url),
 		//chromedp.Evaluate(injectJSCodes(i.url), &res),
 		chromedp.ActionFunc(func(ctx context.Context) error {
@@ -126,38 +339,61 @@ func (i *chromeInstance) makeTasks() chromedp.Tasks {
 			return nil
 		}),
 	}
+	if i.screencastOnly() {
+		tasks = append(tasks, chromedp.ActionFunc(i.startScreencast))
+	}
+	return tasks
 }
 
 func (i *chromeInstance) onPageScreencastFrame(params []byte) {
-	if i.isDoneFlag {
-		logrus.Errorf("chrome (url: %s) instance stopped. task name: %s", i.url, i.taskName)
-		return
-	}
-
 	var psf page.EventScreencastFrame
 
 	if err := psf.UnmarshalJSON(params); err != nil {
-		logrus.WithError(err).Errorf("cant not unmarshal JSON. task name: %s", i.taskName)
+		logrus.WithError(err).Errorf("cant not unmarshal JSON. task name: %s", i.state().taskName)
 		return
 	}
+	i.handleScreencastFrame(&psf)
+}
 
-	//if err := page.ScreencastFrameAck(psf.SessionID).Do(i.actionFunCtx); err != nil {
-	//	logrus.WithError(err).Warnln("cant not unmarshal JSON")
-	//}
+func (i *chromeInstance) handleScreencastFrame(psf *page.EventScreencastFrame) {
+	s := i.state()
+	if s.done {
+		logrus.Errorf("chrome (url: %s) instance stopped. task name: %s", s.url, s.taskName)
+		return
+	}
+
+	i.ackScreencastFrame(psf.SessionID, s.taskName)
+	if s.idle {
+		return
+	}
 
 	jpgData, err := base64.StdEncoding.DecodeString(psf.Data)
 	if err != nil {
-		logrus.WithError(err).Errorln("cant not decode base64 string to jpeg data. task name: %s", i.taskName)
+		logrus.WithError(err).Errorf("cant not decode base64 string to jpeg data. task name: %s", s.taskName)
 		jpgData = []byte{}
 	}
 
+	frameTime := time.Now()
+	if overlay.Enabled() && len(jpgData) > 0 {
+		if data, err := overlay.Apply(s.taskName, jpgData, frameTime); err != nil {
+			logrus.WithError(err).Warnf("draw frame overlay failed. task name: %s", s.taskName)
+		} else {
+			jpgData = data
+		}
+	}
+
 	a := PageScreencastFrameImage(jpgData)
 	i.lastFrameData = &a
-	i.lastFrameTime = time.Now()
+	i.lastFrameTime = frameTime
+	thumbnail.AddFrame(s.taskName, jpgData, frameTime)
+	sendFrame(s.chanPageFrames, &a)
+	if s.encoder != nil && len(jpgData) > 0 {
+		s.encoder.write(jpgData)
+	}
 
 	go func() {
-		if *conf.SaveFrameJpg {
-			dirPath := fmt.Sprintf("%s/%s", *conf.FrameJpgPath, i.taskName)
+		if *conf.SaveFrameJpg && quota.FramesAllowed(s.taskName) {
+			dirPath := fmt.Sprintf("%s/%s", *conf.FrameJpgPath, s.taskName)
 			if !exists(dirPath) {
 				os.MkdirAll(dirPath, 0755)
 			}
@@ -166,13 +402,19 @@ func (i *chromeInstance) onPageScreencastFrame(params []byte) {
 			err = ioutil.WriteFile(fileName, jpgData, 0644)
 			if err != nil {
 				logrus.Errorln(err)
+				return
 			}
+
+			storage.Submit(&storage.Job{
+				Key:       fmt.Sprintf("frames/%s/%s", s.taskName, filepath.Base(fileName)),
+				LocalPath: fileName,
+			})
 		}
 	}()
 }
 
 func (i *chromeInstance) devToolHandler(s string, is ...interface{}) {
-	logrus.Tracef(s, is)
+	logrus.Tracef(s, is...)
 
 	for _, elem := range is {
 		var msg cdproto.Message
@@ -197,17 +439,39 @@ func (i *chromeInstance) devToolHandler(s string, is ...interface{}) {
 func (i *chromeInstance) onPageConsole(params []byte) {
 	consoleEvent := runtime.EventConsoleAPICalled{}
 	if err := consoleEvent.UnmarshalJSON(params); err != nil {
-		logrus.WithError(err).Printf("unmarshal ConsoleAPICalled event failed. task name: %s", i.taskName)
+		logrus.WithError(err).Printf("unmarshal ConsoleAPICalled event failed. task name: %s", i.state().taskName)
 		return
 	}
+	i.handleConsole(&consoleEvent)
+}
 
+func (i *chromeInstance) handleConsole(consoleEvent *runtime.EventConsoleAPICalled) {
+	taskName := i.state().taskName
 	for _, a := range consoleEvent.Args {
-		logrus.Debugf("task name: %s [%s] [%s] %s", i.taskName, consoleEvent.Timestamp.Time(), consoleEvent.Type, a.Description)
+		logrus.Debugf("task name: %s [%s] [%s] %s", taskName, consoleEvent.Timestamp.Time(), consoleEvent.Type, a.Description)
 	}
 }
 
 func (i *chromeInstance) DefaultOptions() []chromedp.ExecAllocatorOption {
-	defaultOptions := append(chromedp.DefaultExecAllocatorOptions[:], i.headless)
+	var defaultOptions []chromedp.ExecAllocatorOption
+	if i.screencastOnly() {
+		defaultOptions = append(chromedp.DefaultExecAllocatorOptions[:], i.headlessScreencast)
+	} else {
+		defaultOptions = append(chromedp.DefaultExecAllocatorOptions[:], i.headless)
+	}
+	if i.display != nil {
+		defaultOptions = append(defaultOptions, chromedp.Env(i.display.Env()))
+	}
+	if i.sink != nil {
+		defaultOptions = append(defaultOptions, chromedp.Env(i.sink.Env()))
+	}
+	if i.profileDir != "" {
+		defaultOptions = append(defaultOptions, chromedp.UserDataDir(i.profileDir))
+	}
+	defaultOptions = append(defaultOptions, i.options.allocatorOptions()...)
+	if launcher := i.cgroupLauncher(); launcher != "" {
+		defaultOptions = append(defaultOptions, chromedp.ExecPath(launcher))
+	}
 	return defaultOptions
 }
 
@@ -219,19 +483,26 @@ func (i *chromeInstance) headless(a *chromedp.ExecAllocator) {
 	//chromedp.Flag("kiosk", true)(a)
 
 	chromedp.Flag("autoplay-policy", "no-user-gesture-required")(a)
-	chromedp.Flag("auto-open-devtools-for-tabs", true)(a)
 
 	chromedp.Flag("disable-extensions", false)(a)
-	chromedp.Flag("load-extension", "/Users/chenfei/Desktop/chrome_render/crx")(a)
-	chromedp.Flag("whitelisted-extension-id", "efjphpadcohhfnlcfjbdiehlnhkomdck")(a)
-	//chromedp.Flag("whitelisted-extension-id", "dbhgfmbemebmbccbpibhhoeddnpicikl")(a)
+	chromedp.Flag("load-extension", i.extensionDir)(a)
+	chromedp.Flag("whitelisted-extension-id", i.extensionID)(a)
 
 	chromedp.Flag("window-size", fmt.Sprintf("%d,%d", i.widthSize, i.heightSize))(a)
-	chromedp.Flag("disable-web-security", true)(a)
+	defaultFlags(a)
 }
 
+// getCurrentDirectory returns the directory of the binary, following the
+// symlinks to it, also when it was started through the PATH.
 func getCurrentDirectory() string {
-	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	path, err := os.Executable()
+	if err == nil {
+		path, err = filepath.EvalSymlinks(path)
+	}
+	if err != nil {
+		path = os.Args[0]
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -264,19 +535,6 @@ func injectJSCodes(url string) string {
 		}
   		return new Blob(byteArrays, {type: contentType});}`,
 
-		`const label = document.createElement("span");
-        label.style.fontSize = "14px";
-        label.style.position = "fixed";
-		label.style.zIndex = "10000";
-        label.style.bottom = "5px";
-        label.style.right = "5px";
-        label.style.color = "rgba(200, 200, 200, 0.8)";
-        setInterval(() => {
-            var n = new Date();
-            label.innerText = n.getFullYear()+"/"+(n.getMonth()+1)+"/"+n.getDate()+" "+n.getHours()+":"+n.getMinutes()+":"+n.getSeconds();
-        }, 1000);
-        document.body.append(label);`,
-
 		fmt.Sprintf(`const base64 = %s`, base64Str),
 		`const blob = b64toBlob(base64, "audio/x-m4a");
 		const blobUrl = URL.createObjectURL(blob);
@@ -293,21 +551,33 @@ func injectJSCodes(url string) string {
 	return jsCodeStr
 }
 
-func NewInstance(ctx context.Context, taskName, url string, widthSize, heightSize int, chPageFrames chan<- *PageScreencastFrameImage) {
+func NewInstance(ctx context.Context, taskName, url string, widthSize, heightSize int, chPageFrames chan<- *PageScreencastFrameImage, opts ...InstanceOption) *chromeInstance {
 	//ctx, cancel := context.WithCancel(parentCtx)
 
-	var chrome = chromeInstance{
+	var chrome = &chromeInstance{
 		taskName:       taskName,
 		url:            url,
 		widthSize:      widthSize,
 		heightSize:     heightSize,
 		chanPageFrames: chPageFrames,
 		isDoneFlag:     false,
+		overlay:        loadOverlay(taskName),
+		mode:           *conf.ChromeMode,
+		startTime:      time.Now(),
+		keepProfile:    *conf.KeepProfile,
+		options:        loadOptions(taskName),
+	}
+	for _, opt := range opts {
+		opt(chrome)
 	}
 
-	logrus.Printf("new chrome browser: %s", chrome.Description())
-
-	chrome.Start(ctx)
+	if pooled := pool.claim(chrome); pooled != nil {
+		chrome = pooled
+	} else {
+		logrus.Printf("new chrome browser: %s", chrome.Description())
+		chrome.Start(ctx)
+	}
+	registerTask(chrome)
 
 	go func() {
 		for {
@@ -319,6 +589,8 @@ func NewInstance(ctx context.Context, taskName, url string, widthSize, heightSiz
 			}
 		}
 	}()
+
+	return chrome
 }
 
 func exists(path string) bool {
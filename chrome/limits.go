@@ -0,0 +1,122 @@
+package chrome
+
+import (
+	"chrome_render/cgroup"
+	"chrome_render/reaper"
+	"chrome_render/wsserver"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"path/filepath"
+	"time"
+)
+
+const cgroupCheckInterval = 5 * time.Second
+
+// ErrOOMKilled fails a task whose processes were killed for going over the
+// memory limit of its cgroup.
+var ErrOOMKilled = errors.New("killed by the memory limit of the task")
+
+// createCgroup puts the task in its own cgroup before its processes start.
+func (i *chromeInstance) createCgroup() {
+	if !cgroup.Enabled() {
+		return
+	}
+
+	group, err := cgroup.Create(i.taskName)
+	if err != nil {
+		logrus.WithError(err).Errorf("create cgroup failed, running without limits. task name: %s", i.taskName)
+		return
+	}
+	i.cgroup = group
+	i.stopWatch = make(chan struct{})
+}
+
+// cgroupLauncher writes the script starting chrome inside the cgroup of the
+// task to its profile, "" runs chrome as it is.
+func (i *chromeInstance) cgroupLauncher() string {
+	if i.cgroup == nil || i.profileDir == "" {
+		return ""
+	}
+
+	chrome := i.options.execPath()
+	if chrome == "" {
+		logrus.Warnf("chrome binary not found, it starts outside the cgroup. task name: %s", i.taskName)
+		return ""
+	}
+	path := filepath.Join(i.profileDir, "cgroup-launcher.sh")
+	if err := i.cgroup.WriteLauncher(path, chrome); err != nil {
+		logrus.WithError(err).Warnf("write cgroup launcher failed, chrome starts outside the cgroup. task name: %s", i.taskName)
+		return ""
+	}
+	return path
+}
+
+// taskPids are the processes started for the task: the browser with its
+// helpers, the display and the encoder.
+func (i *chromeInstance) taskPids() []int {
+	var pids []int
+	if i.pid > 0 {
+		pids = append(append(pids, i.pid), reaper.Descendants(i.pid)...)
+	}
+	if i.display != nil {
+		if pid := i.display.Pid(); pid > 0 {
+			pids = append(pids, pid)
+		}
+	}
+	if enc := i.state().encoder; enc != nil {
+		pids = append(pids, enc.cmd.Process.Pid)
+	}
+	return pids
+}
+
+// watchCgroup moves the processes of the task which could not start in its
+// cgroup into it, and reads back the usage until the task ends.
+func (i *chromeInstance) watchCgroup() {
+	if i.cgroup == nil {
+		return
+	}
+
+	var oomKills uint64
+	ticker := time.NewTicker(cgroupCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := i.cgroup.Add(i.taskPids()...); err != nil {
+			logrus.WithError(err).Warnf("move processes to cgroup failed. task name: %s", i.taskName)
+		}
+
+		usage, err := i.cgroup.Usage()
+		if err != nil {
+			logrus.WithError(err).Warnf("read cgroup usage failed. task name: %s", i.taskName)
+		} else {
+			i.statusLock.Lock()
+			i.usage = usage
+			i.statusLock.Unlock()
+
+			if usage.OOMKills > oomKills {
+				oomKills = usage.OOMKills
+				i.fail(wsserver.EventOOMKilled, fmt.Errorf("%w: %d oom kills, memory max %d MB", ErrOOMKilled, usage.OOMKills, usage.MemoryMax>>20))
+				return
+			}
+		}
+
+		select {
+		case <-i.stopWatch:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fail ends the task with the error as its reason, sent to it as an event
+// of eventType.
+func (i *chromeInstance) fail(eventType string, err error) {
+	i.statusLock.Lock()
+	i.run.Err = err
+	i.statusLock.Unlock()
+
+	logrus.WithError(err).Errorf("chrome task failed. task name: %s", i.taskName)
+	wsserver.Emit(&wsserver.Event{TaskName: i.taskName, Type: eventType, Err: err, Reason: err.Error()})
+	i.release()
+}
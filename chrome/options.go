@@ -0,0 +1,319 @@
+package chrome
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/chromedp/chromedp"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var flagName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// launcherFlags are set by the launcher itself and can't be changed.
+var launcherFlags = map[string]bool{
+	"user-data-dir":            true,
+	"load-extension":           true,
+	"whitelisted-extension-id": true,
+	"remote-debugging-port":    true,
+	"remote-debugging-pipe":    true,
+}
+
+var proxySchemes = map[string]bool{"http": true, "https": true, "socks4": true, "socks5": true}
+
+// ChromeOptions tune the chrome process of a task. Flags are added as name
+// or name=value, NoFlags are default flags left out.
+type ChromeOptions struct {
+	Path        string   `json:"path"`
+	Flags       []string `json:"flags"`
+	NoFlags     []string `json:"noFlags"`
+	ProxyServer string   `json:"proxyServer"`
+	ProxyBypass []string `json:"proxyBypass"`
+	UserAgent   string   `json:"userAgent"`
+	WindowSize  string   `json:"windowSize"`
+}
+
+// WithChromeOptions sets options of the task over the configured ones.
+func WithChromeOptions(opts ChromeOptions) InstanceOption {
+	return func(i *chromeInstance) {
+		i.options = i.options.merge(opts)
+	}
+}
+
+// CheckOptions validates the configured chrome options of every task.
+func CheckOptions() error {
+	for _, f := range splitFlags(*conf.DefaultFlags) {
+		name, _ := splitFlag(f)
+		if err := checkFlagName(name); err != nil {
+			return fmt.Errorf("default chrome flags: %w", err)
+		}
+	}
+
+	opts := globalOptions()
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	tasks, err := readTaskOptions()
+	if err != nil {
+		return err
+	}
+	for taskName, taskOpts := range tasks {
+		if err := opts.merge(taskOpts).validate(); err != nil {
+			return fmt.Errorf("chrome options of task %s: %w", taskName, err)
+		}
+	}
+	return nil
+}
+
+func globalOptions() ChromeOptions {
+	return ChromeOptions{
+		Path:        *conf.ChromePath,
+		Flags:       splitFlags(*conf.ChromeFlags),
+		NoFlags:     splitList(*conf.ChromeNoFlags),
+		ProxyServer: *conf.ProxyServer,
+		ProxyBypass: splitList(*conf.ProxyBypass),
+		UserAgent:   *conf.UserAgent,
+		WindowSize:  *conf.WindowSize,
+	}
+}
+
+func readTaskOptions() (map[string]ChromeOptions, error) {
+	if *conf.ChromeOptions == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(*conf.ChromeOptions)
+	if err != nil {
+		return nil, err
+	}
+	var tasks map[string]ChromeOptions
+	if err := json.Unmarshal(data, &tasks); err != nil {
+		return nil, fmt.Errorf("parse chrome options %s: %w", *conf.ChromeOptions, err)
+	}
+	return tasks, nil
+}
+
+// loadOptions returns the configured options with those of the task, or of
+// "*" for a task without its own, applied over them.
+func loadOptions(taskName string) ChromeOptions {
+	opts := globalOptions()
+
+	tasks, err := readTaskOptions()
+	if err != nil {
+		logrus.WithError(err).Errorf("read chrome options failed. task name: %s", taskName)
+		return opts
+	}
+	if taskOpts, ok := tasks[taskName]; ok {
+		return opts.merge(taskOpts)
+	}
+	if taskOpts, ok := tasks["*"]; ok {
+		return opts.merge(taskOpts)
+	}
+	return opts
+}
+
+// merge returns o with the set fields of over, the flags of both are kept.
+func (o ChromeOptions) merge(over ChromeOptions) ChromeOptions {
+	if over.Path != "" {
+		o.Path = over.Path
+	}
+	o.Flags = append(o.Flags[:len(o.Flags):len(o.Flags)], over.Flags...)
+	o.NoFlags = append(o.NoFlags[:len(o.NoFlags):len(o.NoFlags)], over.NoFlags...)
+	if over.ProxyServer != "" {
+		o.ProxyServer = over.ProxyServer
+	}
+	if len(over.ProxyBypass) > 0 {
+		o.ProxyBypass = over.ProxyBypass
+	}
+	if over.UserAgent != "" {
+		o.UserAgent = over.UserAgent
+	}
+	if over.WindowSize != "" {
+		o.WindowSize = over.WindowSize
+	}
+	return o
+}
+
+func (o ChromeOptions) validate() error {
+	if o.Path != "" {
+		if _, err := exec.LookPath(o.Path); err != nil {
+			return fmt.Errorf("chrome binary %s: %w", o.Path, err)
+		}
+	}
+
+	for _, f := range o.Flags {
+		name, _ := splitFlag(f)
+		if err := checkFlagName(name); err != nil {
+			return err
+		}
+	}
+	for _, name := range o.NoFlags {
+		if err := checkFlagName(strings.TrimPrefix(name, "--")); err != nil {
+			return err
+		}
+	}
+
+	if o.ProxyServer != "" {
+		if err := checkProxy(o.ProxyServer); err != nil {
+			return err
+		}
+	}
+	if o.WindowSize != "" {
+		if _, _, err := parseWindowSize(o.WindowSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocatorOptions applies the options over the default flags.
+func (o ChromeOptions) allocatorOptions() []chromedp.ExecAllocatorOption {
+	var opts []chromedp.ExecAllocatorOption
+	if o.Path != "" {
+		opts = append(opts, chromedp.ExecPath(o.Path))
+	}
+	if o.WindowSize != "" {
+		if width, height, err := parseWindowSize(o.WindowSize); err == nil {
+			opts = append(opts, chromedp.WindowSize(width, height))
+		}
+	}
+	if o.ProxyServer != "" {
+		opts = append(opts, chromedp.ProxyServer(o.ProxyServer))
+		if len(o.ProxyBypass) > 0 {
+			opts = append(opts, chromedp.Flag("proxy-bypass-list", strings.Join(o.ProxyBypass, ";")))
+		}
+	}
+	if o.UserAgent != "" {
+		opts = append(opts, chromedp.UserAgent(o.UserAgent))
+	}
+
+	for _, f := range o.Flags {
+		name, value := splitFlag(f)
+		if value == "" {
+			opts = append(opts, chromedp.Flag(name, true))
+		} else {
+			opts = append(opts, chromedp.Flag(name, value))
+		}
+	}
+	// a false flag is not passed to chrome
+	for _, name := range o.NoFlags {
+		opts = append(opts, chromedp.Flag(strings.TrimPrefix(name, "--"), false))
+	}
+	return opts
+}
+
+// chromeNames are looked up for the binary when no path is configured, as
+// chromedp does.
+var chromeNames = []string{
+	"headless_shell",
+	"headless-shell",
+	"chromium",
+	"chromium-browser",
+	"google-chrome",
+	"google-chrome-stable",
+	"google-chrome-beta",
+	"google-chrome-unstable",
+}
+
+// execPath returns the chrome binary the options start, "" when none is
+// found.
+func (o ChromeOptions) execPath() string {
+	names := chromeNames
+	if o.Path != "" {
+		names = []string{o.Path}
+	}
+	for _, name := range names {
+		if path, err := exec.LookPath(name); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// defaultFlags sets the configured default flags, the mode flags are set
+// before and the options of the task after them.
+func defaultFlags(a *chromedp.ExecAllocator) {
+	for _, f := range splitFlags(*conf.DefaultFlags) {
+		name, value := splitFlag(f)
+		if value == "" {
+			chromedp.Flag(name, true)(a)
+		} else {
+			chromedp.Flag(name, value)(a)
+		}
+	}
+}
+
+func splitFlag(f string) (string, string) {
+	f = strings.TrimPrefix(f, "--")
+	if n := strings.Index(f, "="); n >= 0 {
+		return f[:n], f[n+1:]
+	}
+	return f, ""
+}
+
+func checkFlagName(name string) error {
+	if !flagName.MatchString(name) {
+		return fmt.Errorf("invalid chrome flag %q", name)
+	}
+	if launcherFlags[name] {
+		return fmt.Errorf("chrome flag %s is set by the launcher", name)
+	}
+	return nil
+}
+
+func checkProxy(proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		u, err = url.Parse("http://" + proxy)
+	}
+	if err != nil || !proxySchemes[u.Scheme] {
+		return fmt.Errorf("invalid proxy server %q", proxy)
+	}
+	if _, port, err := net.SplitHostPort(u.Host); err != nil || port == "" {
+		return fmt.Errorf("proxy server %q has no port", proxy)
+	}
+	return nil
+}
+
+func parseWindowSize(size string) (int, int, error) {
+	var width, height int
+	if n, err := fmt.Sscanf(size, "%dx%d", &width, &height); err != nil || n != 2 || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid window size %q, want WIDTHxHEIGHT", size)
+	}
+	return width, height, nil
+}
+
+// splitFlags splits a comma separated list of flags. A comma followed by
+// something else than a flag name belongs to the value of the flag before,
+// e.g. disable-features=A,B is one flag.
+func splitFlags(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		name, _ := splitFlag(item)
+		if n := len(list) - 1; n >= 0 && !flagName.MatchString(name) && strings.Contains(list[n], "=") {
+			list[n] += "," + item
+			continue
+		}
+		list = append(list, item)
+	}
+	return list
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,182 @@
+package chrome
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+)
+
+// Types of overlay elements.
+const (
+	OverlayText  = "text"
+	OverlayClock = "clock"
+	OverlayImage = "image"
+)
+
+// OverlayElement is one element drawn over the page, so it is part of the
+// tab capture. Positions, sizes, font and colours are css values.
+type OverlayElement struct {
+	Type       string `json:"type"`
+	Text       string `json:"text,omitempty"`
+	Format     string `json:"format,omitempty"` // clock, like YYYY/MM/DD HH:mm:ss.SSS
+	Src        string `json:"src,omitempty"`    // image url
+	Top        string `json:"top,omitempty"`
+	Right      string `json:"right,omitempty"`
+	Bottom     string `json:"bottom,omitempty"`
+	Left       string `json:"left,omitempty"`
+	Width      string `json:"width,omitempty"`
+	Height     string `json:"height,omitempty"`
+	Font       string `json:"font,omitempty"`
+	Color      string `json:"color,omitempty"`
+	Background string `json:"background,omitempty"`
+	Opacity    string `json:"opacity,omitempty"`
+	ZIndex     int    `json:"zIndex,omitempty"`
+}
+
+// defaultOverlay is the clock drawn when no overlay is configured.
+var defaultOverlay = []OverlayElement{{
+	Type:   OverlayClock,
+	Format: "YYYY/MM/DD HH:mm:ss",
+	Bottom: "5px",
+	Right:  "5px",
+	Font:   "14px sans-serif",
+	Color:  "rgba(200, 200, 200, 0.8)",
+	ZIndex: 10000,
+}}
+
+// loadOverlay reads the overlay of the task from the overlay file, a json
+// object of element lists by task name where "*" is used for the tasks not
+// listed. An empty list draws nothing.
+func loadOverlay(taskName string) []OverlayElement {
+	if *conf.DomOverlay == "" {
+		return defaultOverlay
+	}
+
+	data, err := ioutil.ReadFile(*conf.DomOverlay)
+	if err != nil {
+		logrus.WithError(err).Errorf("read overlay config failed. task name: %s", taskName)
+		return defaultOverlay
+	}
+	var overlays map[string][]OverlayElement
+	if err := json.Unmarshal(data, &overlays); err != nil {
+		logrus.WithError(err).Errorf("parse overlay config failed. task name: %s", taskName)
+		return defaultOverlay
+	}
+
+	if elements, ok := overlays[taskName]; ok {
+		return elements
+	}
+	return overlays["*"]
+}
+
+// overlayJSCode builds the elements in a fixed container. The script checks
+// every second that the page did not remove the container, and ticks the
+// clocks.
+func overlayJSCode(elements []OverlayElement) string {
+	data, _ := json.Marshal(elements)
+
+	return fmt.Sprintf(`(() => {
+	const elements = %s;
+	const id = "__chrome_render_overlay";
+	const pad = (n, w) => String(n).padStart(w || 2, "0");
+	const format = (f, n) => f.replace(/YYYY|MM|DD|HH|mm|ss|SSS/g, t => ({
+		YYYY: n.getFullYear(), MM: pad(n.getMonth() + 1), DD: pad(n.getDate()),
+		HH: pad(n.getHours()), mm: pad(n.getMinutes()), ss: pad(n.getSeconds()), SSS: pad(n.getMilliseconds(), 3),
+	})[t]);
+	let container = null, clocks = [];
+	const build = () => {
+		container = document.createElement("div");
+		container.id = id;
+		container.style.pointerEvents = "none";
+		clocks = [];
+		for (const e of elements) {
+			const el = document.createElement(e.type === "image" ? "img" : "span");
+			el.style.position = "fixed";
+			el.style.whiteSpace = "pre";
+			el.style.zIndex = String(e.zIndex || 10000);
+			for (const k of ["top", "right", "bottom", "left", "width", "height", "font", "color", "background", "opacity"]) {
+				if (e[k]) el.style[k] = e[k];
+			}
+			if (e.type === "image") el.src = e.src;
+			else if (e.type === "clock") clocks.push([el, e.format || "YYYY/MM/DD HH:mm:ss"]);
+			else el.textContent = e.text || "";
+			container.appendChild(el);
+		}
+	};
+	const tick = () => {
+		const root = document.body || document.documentElement;
+		if (!root) return;
+		if (!container || !container.isConnected) {
+			const old = document.getElementById(id);
+			if (old) old.remove();
+			build();
+			root.appendChild(container);
+		}
+		const n = new Date();
+		for (const [el, f] of clocks) el.textContent = format(f, n);
+	};
+	if (window.__chromeRenderOverlay) clearInterval(window.__chromeRenderOverlay);
+	window.__chromeRenderOverlay = setInterval(tick, 1000);
+	document.addEventListener("DOMContentLoaded", tick);
+	tick();
+	return 0;
+})()`, data)
+}
+
+// registerOverlay makes chrome run the overlay script in every new document,
+// so it is back right after a navigation.
+func (i *chromeInstance) registerOverlay(ctx context.Context) error {
+	if i.overlayScript != "" {
+		if err := page.RemoveScriptToEvaluateOnNewDocument(i.overlayScript).Do(ctx); err != nil {
+			return err
+		}
+		i.overlayScript = ""
+	}
+	elements := i.state().overlay
+	if len(elements) == 0 {
+		return nil
+	}
+
+	identifier, err := page.AddScriptToEvaluateOnNewDocument(overlayJSCode(elements)).Do(ctx)
+	if err != nil {
+		return err
+	}
+	i.overlayScript = identifier
+	return nil
+}
+
+// injectOverlay draws the overlay elements on the current document.
+func (i *chromeInstance) injectOverlay(ctx context.Context, elements []OverlayElement) error {
+	code := overlayJSCode(elements)
+	if len(elements) == 0 {
+		code = `(() => {
+	if (window.__chromeRenderOverlay) clearInterval(window.__chromeRenderOverlay);
+	const old = document.getElementById("__chrome_render_overlay");
+	if (old) old.remove();
+	return 0;
+})()`
+	}
+
+	var res int
+	return chromedp.Evaluate(code, &res).Do(ctx)
+}
+
+// SetOverlay replaces the overlay of the task on the page and after the
+// following navigations.
+func (i *chromeInstance) SetOverlay(elements []OverlayElement) error {
+	i.statusLock.Lock()
+	i.overlay = elements
+	i.statusLock.Unlock()
+	if i.actionFunCtx == nil {
+		return nil
+	}
+
+	if err := i.registerOverlay(i.actionFunCtx); err != nil {
+		return err
+	}
+	return i.injectOverlay(i.actionFunCtx, elements)
+}
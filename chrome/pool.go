@@ -0,0 +1,314 @@
+package chrome
+
+import (
+	"chrome_render/reaper"
+	"context"
+	"fmt"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/storage"
+	"github.com/chromedp/chromedp"
+	"github.com/sirupsen/logrus"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	poolCheckInterval = 10 * time.Second
+	poolRetryDelay    = 10 * time.Second
+)
+
+// browserPool keeps browsers launched ahead of the tasks, so a new task only
+// navigates an idle one instead of waiting for chrome, its display and the
+// extension to start.
+type browserPool struct {
+	lock     sync.Mutex
+	ctx      context.Context
+	idle     []*chromeInstance
+	starting int
+	seq      int
+	refill   chan struct{}
+}
+
+var pool = &browserPool{refill: make(chan struct{}, 1)}
+
+// StartPool keeps the configured number of idle browsers, launching new
+// ones as tasks claim them, until ctx is done.
+func StartPool(ctx context.Context) {
+	// shared tasks open a tab instead of claiming a browser
+	if *conf.PoolSize <= 0 || *conf.ChromeMode == ModeShared {
+		return
+	}
+
+	pool.lock.Lock()
+	pool.ctx = ctx
+	pool.lock.Unlock()
+
+	ticker := time.NewTicker(poolCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		pool.prune()
+		pool.fill()
+
+		select {
+		case <-ctx.Done():
+			pool.drain()
+			return
+		case <-pool.refill:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *browserPool) signal() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+func (p *browserPool) fill() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for len(p.idle)+p.starting < *conf.PoolSize {
+		p.starting++
+		p.seq++
+		go p.launch(p.ctx, fmt.Sprintf("pool_%d", p.seq))
+	}
+}
+
+// launch starts an idle browser of the default size, mode and options.
+func (p *browserPool) launch(ctx context.Context, name string) {
+	i := &chromeInstance{
+		taskName:   name,
+		poolName:   name,
+		url:        "about:blank",
+		widthSize:  *conf.VideoWidth,
+		heightSize: *conf.VideoHeight,
+		mode:       *conf.ChromeMode,
+		options:    loadOptions(""),
+		idle:       true,
+	}
+
+	if err := i.Start(ctx); err != nil {
+		logrus.WithError(err).Errorf("launch pooled browser %s failed", name)
+		time.Sleep(poolRetryDelay)
+
+		p.lock.Lock()
+		p.starting--
+		p.lock.Unlock()
+		p.signal()
+		return
+	}
+
+	p.lock.Lock()
+	p.starting--
+	p.idle = append(p.idle, i)
+	p.lock.Unlock()
+	logrus.Printf("pooled browser %s ready", name)
+}
+
+// prune drops the idle browsers which exited or failed.
+func (p *browserPool) prune() {
+	p.lock.Lock()
+	var dead []*chromeInstance
+	idle := p.idle[:0]
+	for _, i := range p.idle {
+		if i.alive() {
+			idle = append(idle, i)
+		} else {
+			dead = append(dead, i)
+		}
+	}
+	p.idle = idle
+	p.lock.Unlock()
+
+	for _, i := range dead {
+		logrus.Warnf("pooled browser %s is gone, replacing it", i.poolName)
+		i.release()
+	}
+}
+
+func (p *browserPool) drain() {
+	p.lock.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.lock.Unlock()
+
+	for _, i := range idle {
+		i.release()
+	}
+}
+
+// claim hands an idle browser matching the new task over to it, nil when
+// there is none and the task has to launch its own.
+func (p *browserPool) claim(t *chromeInstance) *chromeInstance {
+	if t.keepProfile || t.mode == ModeShared {
+		return nil
+	}
+
+	p.prune()
+	p.lock.Lock()
+	var found *chromeInstance
+	for n, i := range p.idle {
+		if i.widthSize == t.widthSize && i.heightSize == t.heightSize && i.mode == t.mode && reflect.DeepEqual(i.options, t.options) {
+			found = i
+			p.idle = append(p.idle[:n], p.idle[n+1:]...)
+			break
+		}
+	}
+	p.lock.Unlock()
+
+	if found == nil {
+		return nil
+	}
+	p.signal()
+
+	if err := found.assign(t); err != nil {
+		logrus.WithError(err).Errorf("claim pooled browser %s failed. task name: %s", found.poolName, t.taskName)
+		found.release()
+		return nil
+	}
+	logrus.Printf("pooled browser %s claimed, use %d. task name: %s", found.poolName, found.uses, found.taskName)
+	return found
+}
+
+// put takes a browser back after its task is done, unless it served its
+// uses or can't be cleaned, then it is released and replaced.
+func (p *browserPool) put(i *chromeInstance) bool {
+	p.lock.Lock()
+	running := p.ctx != nil && p.ctx.Err() == nil
+	p.lock.Unlock()
+
+	if !running || i.uses >= *conf.PoolMaxUses || !i.alive() {
+		p.signal()
+		return false
+	}
+
+	taskName := i.taskName
+	if err := i.reset(); err != nil {
+		logrus.WithError(err).Errorf("reset pooled browser %s failed. task name: %s", i.poolName, taskName)
+		p.signal()
+		return false
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.idle) >= *conf.PoolSize {
+		return false
+	}
+	p.idle = append(p.idle, i)
+	logrus.Printf("pooled browser %s back in the pool. task name: %s", i.poolName, taskName)
+	return true
+}
+
+func (i *chromeInstance) pooled() bool {
+	return i.poolName != ""
+}
+
+func (i *chromeInstance) alive() bool {
+	i.statusLock.Lock()
+	failed := i.run.Err != nil
+	i.statusLock.Unlock()
+
+	return !failed && i.pid > 0 && reaper.ProcessGroup(i.pid) != 0
+}
+
+// assign gives the idle browser the task of t and navigates to its page.
+func (i *chromeInstance) assign(t *chromeInstance) error {
+	i.statusLock.Lock()
+	i.taskName = t.taskName
+	i.url = t.url
+	i.chanPageFrames = t.chanPageFrames
+	i.overlay = t.overlay
+	i.startTime = t.startTime
+	i.recordErr = nil
+	i.isDoneFlag = false
+	i.idle = false
+	i.uses++
+	i.statusLock.Unlock()
+
+	i.bindTask()
+	if err := i.reloadExtension(); err != nil {
+		return err
+	}
+	return chromedp.Run(i.startCtx,
+		chromedp.ActionFunc(i.registerOverlay),
+		chromedp.Navigate(i.url))
+}
+
+// reset clears what the task left in the browser and makes it idle again.
+func (i *chromeInstance) reset() error {
+	origin := ""
+	if u, err := url.Parse(i.url); err == nil && u.Host != "" {
+		origin = u.Scheme + "://" + u.Host
+	}
+
+	i.unbindTask()
+	i.statusLock.Lock()
+	i.idle = true
+	i.taskName = i.poolName
+	i.url = "about:blank"
+	i.chanPageFrames = nil
+	i.overlay = nil
+	i.statusLock.Unlock()
+	if err := i.reloadExtension(); err != nil {
+		return err
+	}
+
+	actions := chromedp.Tasks{
+		chromedp.Navigate("about:blank"),
+		chromedp.ActionFunc(i.registerOverlay),
+		network.ClearBrowserCookies(),
+		network.ClearBrowserCache(),
+	}
+	if origin != "" {
+		actions = append(actions, storage.ClearDataForOrigin(origin, "all"))
+	}
+	return chromedp.Run(i.startCtx, actions)
+}
+
+// reloadExtension rewrites the task of the extension and reloads its
+// background page, which connects to the recording server for that task.
+func (i *chromeInstance) reloadExtension() error {
+	if i.extensionDir == "" {
+		return nil
+	}
+	if err := writeTaskJS(filepath.Join(i.extensionDir, "js", "task.js"), i.extensionTask()); err != nil {
+		return err
+	}
+
+	ctx, err := i.backgroundPage()
+	if err != nil {
+		return err
+	}
+	var res int
+	return chromedp.Run(ctx, chromedp.Evaluate("location.reload(), 0", &res))
+}
+
+// backgroundPage returns the context attached to the background page of the
+// extension. It is kept for all the tasks of the browser, cancelling it would
+// close the page, and goes with the browser context on release.
+func (i *chromeInstance) backgroundPage() (context.Context, error) {
+	if i.extensionCtx != nil {
+		return i.extensionCtx, nil
+	}
+
+	targets, err := chromedp.Targets(i.startCtx)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range targets {
+		if t.Type != "background_page" || !strings.HasPrefix(t.URL, "chrome-extension://"+i.extensionID+"/") {
+			continue
+		}
+		i.extensionCtx, _ = chromedp.NewContext(i.startCtx, chromedp.WithTargetID(t.TargetID))
+		return i.extensionCtx, nil
+	}
+	return nil, fmt.Errorf("background page of extension %s not found", i.extensionID)
+}
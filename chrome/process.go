@@ -0,0 +1,110 @@
+package chrome
+
+import (
+	"chrome_render/cgroup"
+	"chrome_render/reaper"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// InstanceStatus is the state of the chrome process of a task.
+type InstanceStatus struct {
+	TaskName string        `json:"taskName"`
+	Url      string        `json:"url"`
+	Mode     string        `json:"mode"`
+	Pid      int           `json:"pid"`
+	Pgid     int           `json:"pgid"`
+	Display  string        `json:"display,omitempty"`
+	Target   string        `json:"target,omitempty"`
+	Done     bool          `json:"done"`
+	Error    string        `json:"error,omitempty"`
+	Usage    *cgroup.Usage `json:"usage,omitempty"`
+	Start    time.Time     `json:"start"`
+	Record   *RecordReport `json:"record"`
+}
+
+// Status returns the state of the chrome process.
+func (i *chromeInstance) Status() *InstanceStatus {
+	i.statusLock.Lock()
+	defer i.statusLock.Unlock()
+
+	status := &InstanceStatus{
+		TaskName: i.taskName,
+		Url:      i.url,
+		Mode:     i.mode,
+		Pid:      i.run.PID,
+		Pgid:     i.pgid,
+		Done:     i.isDoneFlag,
+		Usage:    i.usage,
+		Start:    i.startTime,
+		Record:   i.RecordReport(),
+	}
+	if i.display != nil {
+		status.Display = i.display.Name()
+	}
+	if i.targetID != "" {
+		status.Target = string(i.targetID)
+	}
+	if i.run.Err != nil {
+		status.Error = i.run.Err.Error()
+	}
+	return status
+}
+
+// trackBrowser records the browser process of the task.
+func (i *chromeInstance) trackBrowser() {
+	if i.profileDir == "" {
+		return
+	}
+
+	pid := findBrowser(i.profileDir)
+	if pid == 0 {
+		logrus.Warnf("chrome process not found. task name: %s", i.taskName)
+		return
+	}
+
+	p, err := reaper.Track("chrome", i.taskName, pid)
+	if err != nil {
+		logrus.WithError(err).Warnf("track chrome %d failed. task name: %s", pid, i.taskName)
+	}
+	i.pid = pid
+	if p != nil {
+		i.pgid = p.Pgid
+	}
+	logrus.Printf("chrome pid %d, process group %d. task name: %s", i.pid, i.pgid, i.taskName)
+}
+
+// findBrowser finds the browser process by the profile only it uses, its
+// helper processes are told apart by their --type flag.
+func findBrowser(profileDir string) int {
+	for _, pid := range reaper.FindByArgs("--user-data-dir=" + profileDir) {
+		if !isHelperProcess(pid) {
+			return pid
+		}
+	}
+	return 0
+}
+
+// killBrowser terminates the browser and its helpers, including those
+// already orphaned by the browser exiting first.
+func (i *chromeInstance) killBrowser() {
+	if i.pid > 0 {
+		reaper.KillTree(i.pid)
+		reaper.Untrack("chrome", i.pid)
+	}
+	if i.profileDir != "" {
+		for _, pid := range reaper.FindByArgs("--user-data-dir=" + i.profileDir) {
+			reaper.KillTree(pid)
+		}
+	}
+}
+
+func isHelperProcess(pid int) bool {
+	for _, arg := range reaper.Args(pid) {
+		if strings.HasPrefix(arg, "--type=") {
+			return true
+		}
+	}
+	return false
+}
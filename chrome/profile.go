@@ -0,0 +1,95 @@
+package chrome
+
+import (
+	"github.com/sirupsen/logrus"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WithKeepProfile keeps the profile of the task after it exits, by default
+// the configured keep-profile.
+func WithKeepProfile(keep bool) InstanceOption {
+	return func(i *chromeInstance) {
+		i.keepProfile = keep
+	}
+}
+
+// prepareProfile creates the user data dir of the task from the template, so
+// no cookies or cache are shared with another task.
+func (i *chromeInstance) prepareProfile() error {
+	dir, err := createProfile()
+	if err != nil {
+		return err
+	}
+
+	i.profileDir = dir
+	logrus.Printf("chrome profile %s created. task name: %s", dir, i.taskName)
+	return nil
+}
+
+func createProfile() (string, error) {
+	if *conf.ProfilePath != "" {
+		if err := os.MkdirAll(*conf.ProfilePath, 0755); err != nil {
+			return "", err
+		}
+	}
+
+	dir, err := ioutil.TempDir(*conf.ProfilePath, "chrome_render_profile_")
+	if err != nil {
+		return "", err
+	}
+
+	if *conf.ProfileTemplate != "" {
+		if err := copyTree(os.DirFS(*conf.ProfileTemplate), dir); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+func (i *chromeInstance) removeProfile() {
+	if i.profileDir == "" {
+		return
+	}
+	if i.keepProfile {
+		logrus.Printf("chrome profile %s kept. task name: %s", i.profileDir, i.taskName)
+		return
+	}
+
+	if err := os.RemoveAll(i.profileDir); err != nil {
+		logrus.WithError(err).Errorf("remove chrome profile %s failed. task name: %s", i.profileDir, i.taskName)
+	}
+}
+
+// copyTree copies the regular files of src into dir, skipping hidden files
+// and links like the singleton locks of a profile.
+func copyTree(src fs.FS, dir string) error {
+	return fs.WalkDir(src, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name != "." && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		data, err := fs.ReadFile(src, name)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, data, 0644)
+	})
+}
@@ -0,0 +1,139 @@
+package chrome
+
+import (
+	"chrome_render/catalog"
+	"chrome_render/wsserver"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// RecordSegment is a finished recording file of the task and where the
+// storage backend put it.
+type RecordSegment struct {
+	Id       string `json:"id"`
+	Path     string `json:"path"`
+	Segment  int    `json:"segment"`
+	Location string `json:"location"`
+	State    string `json:"state"`
+}
+
+// RecordReport is the recording part of the task report.
+type RecordReport struct {
+	TaskName string          `json:"taskName"`
+	Url      string          `json:"url"`
+	Segments []RecordSegment `json:"segments"`
+}
+
+// captureOptions are the extension recorder settings of the task, taken from
+// the instance size and the configured rates.
+func (i *chromeInstance) captureOptions() wsserver.CaptureOptions {
+	return wsserver.CaptureOptions{
+		VideoBitRate: *conf.ForceVideoBitRate * 1000,
+		AudioBitRate: *conf.ForceAudioBitRate * 1000,
+		FrameRate:    *conf.ForceFrameRate,
+		Width:        i.widthSize,
+		Height:       i.heightSize,
+	}
+}
+
+// StartRecording (re)starts the tab capture of the extension.
+func (i *chromeInstance) StartRecording() error {
+	return wsserver.SendCommand(i.taskName, wsserver.ActionStart, i.captureOptions())
+}
+
+// StopRecording stops the tab capture of the extension.
+func (i *chromeInstance) StopRecording() error {
+	return wsserver.SendCommand(i.taskName, wsserver.ActionStop, wsserver.CaptureOptions{})
+}
+
+func (i *chromeInstance) PauseRecording() error {
+	return wsserver.SendCommand(i.taskName, wsserver.ActionPause, wsserver.CaptureOptions{})
+}
+
+func (i *chromeInstance) ResumeRecording() error {
+	return wsserver.SendCommand(i.taskName, wsserver.ActionResume, wsserver.CaptureOptions{})
+}
+
+// SetBitrate changes the recorder bitrates, in kb/s like the config flags.
+// The extension restarts its MediaRecorder, the recording continues in the
+// same file.
+func (i *chromeInstance) SetBitrate(videoBitRate, audioBitRate int) error {
+	opts := wsserver.CaptureOptions{
+		VideoBitRate: videoBitRate * 1000,
+		AudioBitRate: audioBitRate * 1000,
+	}
+	return wsserver.SendCommand(i.taskName, wsserver.ActionSetBitrate, opts)
+}
+
+// RecorderStats returns the last MediaRecorder stats sent by the extension.
+func (i *chromeInstance) RecorderStats() (*wsserver.RecorderStats, bool) {
+	return wsserver.GetRecorderStats(i.taskName)
+}
+
+// RecordError returns the last write error of the recording, nil once a new
+// recording started.
+func (i *chromeInstance) RecordError() error {
+	i.statusLock.Lock()
+	defer i.statusLock.Unlock()
+
+	return i.recordErr
+}
+
+func (i *chromeInstance) setRecordError(err error) {
+	i.statusLock.Lock()
+	i.recordErr = err
+	i.statusLock.Unlock()
+}
+
+// AudioLevel returns the loudness gauge of the current recording.
+func (i *chromeInstance) AudioLevel() (*wsserver.AudioLevel, bool) {
+	return wsserver.GetAudioLevel(i.taskName)
+}
+
+// RecordReport lists the recorded segments of the task with their remote
+// urls once uploaded.
+func (i *chromeInstance) RecordReport() *RecordReport {
+	return recordReport(i.taskName, i.url, i.startTime)
+}
+
+// recordReport is taken from the catalog, which follows the uploads still
+// running after the task is done.
+func recordReport(taskName, url string, from time.Time) *RecordReport {
+	report := &RecordReport{TaskName: taskName, Url: url, Segments: []RecordSegment{}}
+	for _, rec := range catalog.List(catalog.Filter{TaskName: taskName, From: from}) {
+		if len(rec.ClipOf) > 0 {
+			continue
+		}
+		report.Segments = append(report.Segments, RecordSegment{
+			Id:       rec.Id,
+			Path:     rec.Path,
+			Segment:  rec.Segment,
+			Location: rec.Location,
+			State:    rec.State,
+		})
+	}
+	return report
+}
+
+func (i *chromeInstance) onRecordEvent(ev *wsserver.Event) {
+	switch ev.Type {
+	case wsserver.EventUploaded:
+		if ev.Err != nil {
+			logrus.WithError(ev.Err).Errorf("recording %s not uploaded. task name: %s", ev.Path, i.taskName)
+			return
+		}
+		logrus.Printf("recording %s stored at %s. task name: %s", ev.Path, ev.Location, i.taskName)
+	case wsserver.EventWriteError:
+		i.setRecordError(ev.Err)
+		logrus.WithError(ev.Err).Errorf("recording %s failed, disk full: %v. task name: %s", ev.Path, ev.DiskFull, i.taskName)
+	case wsserver.EventSilence:
+		logrus.Warnf("recording %s silent for %d seconds, autoplay may have failed. task name: %s", ev.Path, ev.SilentFor, i.taskName)
+	case wsserver.EventQuotaExceeded, wsserver.EventQuotaRecovered:
+		logrus.Warnf("disk guard %s: %s. task name: %s", ev.Type, ev.Reason, i.taskName)
+	case wsserver.EventRecordStarted:
+		i.setRecordError(nil)
+		logrus.Printf("recording %s started. task name: %s", ev.Path, i.taskName)
+	default:
+		logrus.Debugf("recording %s event: %s. task name: %s", ev.Path, ev.Type, i.taskName)
+	}
+}
@@ -0,0 +1,84 @@
+package chrome
+
+import (
+	"context"
+	"fmt"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+	"github.com/sirupsen/logrus"
+)
+
+// Modes of an instance.
+const (
+	// ModeRecord runs a real window on its own display with the extension
+	// recording the tab.
+	ModeRecord = "record"
+	// ModeScreencast runs headless without display and extension, the
+	// page is only seen through the screencast frames.
+	ModeScreencast = "screencast"
+)
+
+// InstanceOption changes how an instance is started.
+type InstanceOption func(*chromeInstance)
+
+// WithMode sets the mode of the instance, by default the configured one.
+func WithMode(mode string) InstanceOption {
+	return func(i *chromeInstance) {
+		i.mode = mode
+	}
+}
+
+func (i *chromeInstance) screencastOnly() bool {
+	return i.mode == ModeScreencast || i.mode == ModeShared
+}
+
+// headlessScreencast are the flags of a screencast instance on top of the
+// default headless ones, which already disable extensions.
+func (i *chromeInstance) headlessScreencast(a *chromedp.ExecAllocator) {
+	chromedp.Flag("disable-gpu", true)(a)
+	chromedp.Flag("window-size", fmt.Sprintf("%d,%d", i.widthSize, i.heightSize))(a)
+	defaultFlags(a)
+
+	// headless mutes the page, unmute it when its audio goes to a sink
+	if i.sink != nil {
+		chromedp.Flag("mute-audio", false)(a)
+		chromedp.Flag("autoplay-policy", "no-user-gesture-required")(a)
+	}
+}
+
+// startScreencast makes chrome send the page frames as jpegs of the
+// instance size.
+func (i *chromeInstance) startScreencast(ctx context.Context) error {
+	return page.StartScreencast().
+		WithFormat(page.ScreencastFormatJpeg).
+		WithQuality(int64(*conf.JpegQuality)).
+		WithMaxWidth(int64(i.widthSize)).
+		WithMaxHeight(int64(i.heightSize)).
+		Do(ctx)
+}
+
+// ackScreencastFrame lets chrome send the next frame.
+func (i *chromeInstance) ackScreencastFrame(sessionID int64, taskName string) {
+	if i.actionFunCtx == nil {
+		return
+	}
+
+	go func() {
+		if err := page.ScreencastFrameAck(sessionID).Do(i.actionFunCtx); err != nil {
+			logrus.WithError(err).Debugf("ack screencast frame failed. task name: %s", taskName)
+		}
+	}()
+}
+
+// sendFrame passes a frame to the frame channel of the task, dropping it
+// when the reader falls behind.
+func sendFrame(chFrames chan<- *PageScreencastFrameImage, frame *PageScreencastFrameImage) {
+	if chFrames == nil {
+		return
+	}
+
+	select {
+	case chFrames <- frame:
+	default:
+	}
+}
@@ -0,0 +1,301 @@
+package chrome
+
+import (
+	"chrome_render/reaper"
+	"chrome_render/wsserver"
+	"context"
+	"errors"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/cdproto/target"
+	"github.com/chromedp/chromedp"
+	"github.com/sirupsen/logrus"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ModeShared runs the task as a tab of a headless browser shared with the
+// other shared tasks, each in its own browser context so they see none of
+// each other's cookies or storage.
+const ModeShared = "shared"
+
+// ErrBrowserExited fails the shared tasks whose browser exited under them.
+var ErrBrowserExited = errors.New("shared browser exited")
+
+const (
+	sharedCommandTimeout = 10 * time.Second
+	sharedCloseTimeout   = 5 * time.Second
+)
+
+// sharedBrowser is the browser of the shared tasks, launched by the first
+// one and closed with the last one.
+type sharedBrowser struct {
+	lock       sync.Mutex
+	ctx        context.Context
+	cancel     context.CancelFunc
+	profileDir string
+	pid        int
+
+	// tabs has its own lock as the events are dispatched by chromedp while
+	// lock may be held waiting for a reply of the browser
+	tabsLock sync.Mutex
+	tabs     map[target.ID]*chromeInstance
+}
+
+var shared = &sharedBrowser{tabs: map[target.ID]*chromeInstance{}}
+
+// launch starts the browser with the global chrome options, the options of
+// a task only apply to the browser it launches itself.
+func (b *sharedBrowser) launch() error {
+	dir, err := createProfile()
+	if err != nil {
+		return err
+	}
+
+	opts := append(chromedp.DefaultExecAllocatorOptions[:], headlessShared, chromedp.UserDataDir(dir))
+	opts = append(opts, globalOptions().allocatorOptions()...)
+
+	allocCtx, cancel := chromedp.NewExecAllocator(context.Background(), opts...)
+	ctx, _ := chromedp.NewContext(allocCtx, chromedp.WithErrorf(logrus.Errorf))
+	if err := chromedp.Run(ctx); err != nil {
+		cancel()
+		os.RemoveAll(dir)
+		return err
+	}
+
+	b.ctx = ctx
+	b.cancel = cancel
+	b.profileDir = dir
+	b.pid = findBrowser(dir)
+	if b.pid > 0 {
+		if _, err := reaper.Track("chrome", ModeShared, b.pid); err != nil {
+			logrus.WithError(err).Warnf("track shared chrome %d failed", b.pid)
+		}
+	}
+	logrus.Printf("shared chrome started, pid %d, profile %s", b.pid, dir)
+	return nil
+}
+
+// close stops the browser, the caller holds the lock.
+func (b *sharedBrowser) close() {
+	if b.ctx == nil {
+		return
+	}
+
+	b.cancel()
+	if b.pid > 0 {
+		reaper.KillTree(b.pid)
+		reaper.Untrack("chrome", b.pid)
+	}
+	for _, pid := range reaper.FindByArgs("--user-data-dir=" + b.profileDir) {
+		reaper.KillTree(pid)
+	}
+	os.RemoveAll(b.profileDir)
+	logrus.Printf("shared chrome %d closed", b.pid)
+
+	b.ctx = nil
+	b.cancel = nil
+	b.profileDir = ""
+	b.pid = 0
+}
+
+// browser executes commands on the browser instead of one of its targets,
+// they fail after timeout as a hung browser never replies.
+func (b *sharedBrowser) browser(timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(cdp.WithExecutor(b.ctx, chromedp.FromContext(b.ctx).Browser), timeout)
+}
+
+// alive tells whether the browser still runs, the caller holds the lock.
+// chromedp doesn't cancel the context when chrome crashes, so the process
+// group is checked, unless the browser process was not found.
+func (b *sharedBrowser) alive() bool {
+	if b.ctx == nil || b.ctx.Err() != nil {
+		return false
+	}
+	return b.pid <= 0 || reaper.ProcessGroup(b.pid) != 0
+}
+
+// openTab creates the target of the task in a new browser context, launching
+// the browser first when no shared task runs. The events of the target are
+// routed to the task by its target id.
+func (b *sharedBrowser) openTab(i *chromeInstance) (context.Context, context.CancelFunc, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// the browser exited under the tabs still open, start a new one
+	if b.ctx != nil && !b.alive() {
+		logrus.Warnf("shared chrome %d exited, restarting it", b.pid)
+		orphans := b.dropTabs()
+		b.close()
+		// their release closes the tab, which waits for the lock
+		for _, orphan := range orphans {
+			go orphan.fail(wsserver.EventBrowserExited, ErrBrowserExited)
+		}
+	}
+	if b.ctx == nil {
+		if err := b.launch(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	browser, cancel := b.browser(sharedCommandTimeout)
+	defer cancel()
+
+	browserContextID, err := target.CreateBrowserContext().Do(browser)
+	if err != nil {
+		b.closeIfUnused()
+		return nil, nil, err
+	}
+	targetID, err := target.CreateTarget("about:blank").WithBrowserContextID(browserContextID).Do(browser)
+	if err != nil {
+		dispose, cancel := b.browser(sharedCloseTimeout)
+		target.DisposeBrowserContext(browserContextID).Do(dispose)
+		cancel()
+		b.closeIfUnused()
+		return nil, nil, err
+	}
+
+	i.targetID = targetID
+	i.browserContextID = browserContextID
+	count := b.addTab(targetID, i)
+
+	ctx, cancel := chromedp.NewContext(b.ctx, chromedp.WithTargetID(targetID))
+	chromedp.ListenTarget(ctx, func(ev interface{}) {
+		b.dispatch(targetID, ev)
+	})
+	logrus.Printf("shared chrome tab %s opened, %d tabs. task name: %s", targetID, count, i.taskName)
+	return ctx, cancel, nil
+}
+
+// closeTab disposes the browser context of the task, closing the browser
+// when it was the last tab.
+func (b *sharedBrowser) closeTab(i *chromeInstance) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	count, ok := b.removeTab(i)
+	if !ok {
+		return
+	}
+
+	if b.alive() {
+		ctx, cancel := b.browser(sharedCloseTimeout)
+		if err := target.DisposeBrowserContext(i.browserContextID).Do(ctx); err != nil {
+			logrus.WithError(err).Warnf("dispose browser context failed. task name: %s", i.taskName)
+		}
+		cancel()
+	}
+	logrus.Printf("shared chrome tab %s closed, %d tabs. task name: %s", i.targetID, count, i.taskName)
+	b.closeIfUnused()
+}
+
+func (b *sharedBrowser) closeIfUnused() {
+	b.tabsLock.Lock()
+	count := len(b.tabs)
+	b.tabsLock.Unlock()
+
+	if count == 0 {
+		b.close()
+	}
+}
+
+func (b *sharedBrowser) addTab(id target.ID, i *chromeInstance) int {
+	b.tabsLock.Lock()
+	defer b.tabsLock.Unlock()
+
+	b.tabs[id] = i
+	return len(b.tabs)
+}
+
+func (b *sharedBrowser) removeTab(i *chromeInstance) (int, bool) {
+	b.tabsLock.Lock()
+	defer b.tabsLock.Unlock()
+
+	if b.tabs[i.targetID] != i {
+		return len(b.tabs), false
+	}
+	delete(b.tabs, i.targetID)
+	return len(b.tabs), true
+}
+
+// dropTabs forgets the tabs of a browser which exited and returns their
+// tasks, closing them later is a no-op.
+func (b *sharedBrowser) dropTabs() []*chromeInstance {
+	b.tabsLock.Lock()
+	defer b.tabsLock.Unlock()
+
+	tasks := make([]*chromeInstance, 0, len(b.tabs))
+	for _, i := range b.tabs {
+		tasks = append(tasks, i)
+	}
+	b.tabs = map[target.ID]*chromeInstance{}
+	return tasks
+}
+
+func (b *sharedBrowser) dispatch(id target.ID, ev interface{}) {
+	b.tabsLock.Lock()
+	i := b.tabs[id]
+	b.tabsLock.Unlock()
+
+	if i != nil {
+		i.onTargetEvent(ev)
+	}
+}
+
+// onTargetEvent handles the events of a shared task, which has no log hook
+// of its own as the browser is not started by it.
+func (i *chromeInstance) onTargetEvent(ev interface{}) {
+	switch ev := ev.(type) {
+	case *page.EventLoadEventFired:
+		i.onPageLoadFired()
+	case *page.EventScreencastFrame:
+		i.handleScreencastFrame(ev)
+	case *runtime.EventConsoleAPICalled:
+		i.handleConsole(ev)
+	}
+}
+
+// startShared opens the task in the shared browser, the xvfb, audio sink
+// and cgroup of the other modes are per browser so a shared task has none.
+func (i *chromeInstance) startShared() error {
+	// the user agent and size are set per tab, the rest is the browser's
+	global, task := globalOptions(), i.options
+	global.UserAgent, task.UserAgent = "", ""
+	global.WindowSize, task.WindowSize = "", ""
+	if !reflect.DeepEqual(global, task) {
+		logrus.Warnf("chrome binary, flags and proxy of the task are ignored by the shared browser. task name: %s", i.taskName)
+	}
+
+	ctx, cancel, err := shared.openTab(i)
+	if err != nil {
+		logrus.WithError(err).Errorf("open shared chrome tab failed. task name: %s", i.taskName)
+		i.release()
+		return err
+	}
+	i.cancel = cancel
+	i.startCtx = ctx
+
+	i.bindTask()
+
+	tasks := i.makeTasks()
+	if i.options.UserAgent != "" {
+		tasks = append(chromedp.Tasks{emulation.SetUserAgentOverride(i.options.UserAgent)}, tasks...)
+	}
+	if err = chromedp.Run(ctx, tasks); err != nil {
+		logrus.WithError(err).Errorf("chromedp run tasks error. task name: %s", i.taskName)
+		i.release()
+		return err
+	}
+	return nil
+}
+
+// headlessShared are the flags of the shared browser on top of the default
+// headless ones, the size is set per tab.
+func headlessShared(a *chromedp.ExecAllocator) {
+	chromedp.Flag("disable-gpu", true)(a)
+	defaultFlags(a)
+}
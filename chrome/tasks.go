@@ -0,0 +1,103 @@
+package chrome
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// taskRetention is how long a done task stays listed, the uploads of its
+// last segments still show in its record report meanwhile.
+const taskRetention = 30 * time.Minute
+
+// taskEntry is a running task, or the last status of a done one as its
+// chrome may already serve another task of the pool.
+type taskEntry struct {
+	instance  *chromeInstance
+	status    *InstanceStatus
+	startTime time.Time
+	doneTime  time.Time
+}
+
+var (
+	tasksLock sync.Mutex
+	tasks     = map[string]*taskEntry{}
+)
+
+func registerTask(i *chromeInstance) {
+	tasksLock.Lock()
+	defer tasksLock.Unlock()
+
+	tasks[i.taskName] = &taskEntry{instance: i, startTime: i.startTime}
+}
+
+// finishTask keeps the status of the task as it is done, before its chrome
+// is put back to the pool.
+func finishTask(i *chromeInstance) {
+	status := i.Status()
+
+	tasksLock.Lock()
+	defer tasksLock.Unlock()
+
+	entry := tasks[status.TaskName]
+	if entry == nil || entry.instance != i {
+		return
+	}
+	entry.instance = nil
+	entry.status = status
+	entry.doneTime = time.Now()
+}
+
+func (e *taskEntry) report() *InstanceStatus {
+	if e.instance != nil {
+		return e.instance.Status()
+	}
+	status := *e.status
+	status.Record = recordReport(status.TaskName, status.Url, e.startTime)
+	return &status
+}
+
+// TaskStatus returns the status of a running or recently done task, nil
+// when the task is unknown.
+func TaskStatus(taskName string) *InstanceStatus {
+	tasksLock.Lock()
+	expireTasks()
+	entry := tasks[taskName]
+	tasksLock.Unlock()
+
+	if entry == nil {
+		return nil
+	}
+	return entry.report()
+}
+
+// TaskStatuses returns the status of the running and recently done tasks
+// by task name.
+func TaskStatuses() []*InstanceStatus {
+	tasksLock.Lock()
+	expireTasks()
+	entries := make([]*taskEntry, 0, len(tasks))
+	for _, entry := range tasks {
+		entries = append(entries, entry)
+	}
+	tasksLock.Unlock()
+
+	statuses := make([]*InstanceStatus, 0, len(entries))
+	for _, entry := range entries {
+		statuses = append(statuses, entry.report())
+	}
+	sort.Slice(statuses, func(a, b int) bool {
+		return statuses[a].TaskName < statuses[b].TaskName
+	})
+	return statuses
+}
+
+// expireTasks drops the done tasks past the retention, the caller holds
+// tasksLock.
+func expireTasks() {
+	for name, entry := range tasks {
+		if entry.instance == nil && time.Since(entry.doneTime) > taskRetention {
+			delete(tasks, name)
+		}
+	}
+}
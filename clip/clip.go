@@ -0,0 +1,492 @@
+package clip
+
+import (
+	"bufio"
+	"chrome_render/catalog"
+	"chrome_render/config"
+	"chrome_render/webm"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Formats of a clip.
+const (
+	FormatWebm = "webm"
+	FormatMp4  = "mp4"
+)
+
+const readChunkSize = 1 << 20
+
+var conf = config.GetConfig()
+
+var fetchClient = &http.Client{Timeout: 10 * time.Minute}
+
+var (
+	ErrInvalidRange = errors.New("invalid clip range")
+	ErrFormat       = errors.New("unsupported clip format")
+	ErrNoRecording  = errors.New("no recording in clip range")
+
+	errDone = errors.New("clip range done")
+)
+
+// Request selects a clip of a task. A wall-clock range From - To is used
+// when set, otherwise Start - End are seconds from the start of the session,
+// by default the last session of the task.
+type Request struct {
+	TaskName  string    `json:"task"`
+	SessionId string    `json:"session"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Start     float64   `json:"start"`
+	End       float64   `json:"end"`
+	Format    string    `json:"format"`
+}
+
+// Extract cuts the requested range out of the recorded segments and adds the
+// clip to the catalog. WebM clips are stream copied, so they start at the
+// last keyframe before the range; MP4 clips are transcoded by ffmpeg.
+func Extract(req *Request) (*catalog.Recording, error) {
+	if req.TaskName == "" {
+		return nil, fmt.Errorf("%w: task is required", ErrInvalidRange)
+	}
+	if req.Format == "" {
+		req.Format = FormatWebm
+	}
+	if req.Format != FormatWebm && req.Format != FormatMp4 {
+		return nil, ErrFormat
+	}
+
+	segments, err := locate(req)
+	if err != nil {
+		return nil, err
+	}
+	fetched, err := fetch(segments)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, path := range fetched {
+			os.Remove(path)
+		}
+	}()
+
+	dirPath := *conf.LocalVideoPath
+	id := fmt.Sprintf("%s_clip%d", req.TaskName, time.Now().UnixNano())
+	path := filepath.Join(dirPath, id+".webm")
+	rawPath := path + ".cut"
+	defer os.Remove(rawPath)
+
+	c, err := cut(rawPath, segments, req.From, req.To)
+	if err != nil {
+		return nil, err
+	}
+	if err := finalize(rawPath, path); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	codecs := segments[0].Codecs
+	if req.Format == FormatMp4 {
+		mp4Path := filepath.Join(dirPath, id+".mp4")
+		err := transcode(path, mp4Path)
+		os.Remove(path)
+		if err != nil {
+			os.Remove(mp4Path)
+			return nil, err
+		}
+		path = mp4Path
+		codecs = []string{"h264", "aac"}
+	}
+
+	size, sum, err := digest(path)
+	if err != nil {
+		return nil, err
+	}
+
+	clipOf := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		clipOf = append(clipOf, segment.Id)
+	}
+	entry := &catalog.Recording{
+		Id:        id,
+		TaskName:  req.TaskName,
+		Url:       segments[0].Url,
+		SessionId: segments[0].SessionId,
+		StartTime: c.start,
+		EndTime:   c.end,
+		Duration:  c.end.Sub(c.start).Seconds(),
+		Size:      size,
+		Codecs:    codecs,
+		Sha256:    sum,
+		Path:      path,
+		Location:  path,
+		State:     catalog.StateFinished,
+		ClipOf:    clipOf,
+	}
+	if err := catalog.Add(entry); err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("clip %s of task %s: %s - %s from %d segments", id, req.TaskName, c.start.Format(time.RFC3339), c.end.Format(time.RFC3339), len(segments))
+	return entry, nil
+}
+
+// locate resolves the range of req to wall-clock time and returns the
+// recorded segments overlapping it.
+func locate(req *Request) ([]*catalog.Recording, error) {
+	var recordings []*catalog.Recording
+	for _, rec := range catalog.List(catalog.Filter{TaskName: req.TaskName}) {
+		if len(rec.ClipOf) == 0 {
+			recordings = append(recordings, rec)
+		}
+	}
+	if len(recordings) == 0 {
+		return nil, ErrNoRecording
+	}
+
+	if req.From.IsZero() && req.To.IsZero() {
+		if req.SessionId == "" {
+			req.SessionId = recordings[len(recordings)-1].SessionId
+		}
+
+		var base time.Time
+		for _, rec := range recordings {
+			if rec.SessionId == req.SessionId && (base.IsZero() || rec.StartTime.Before(base)) {
+				base = rec.StartTime
+			}
+		}
+		if base.IsZero() {
+			return nil, ErrNoRecording
+		}
+		req.From = base.Add(time.Duration(req.Start * float64(time.Second)))
+		req.To = base.Add(time.Duration(req.End * float64(time.Second)))
+	}
+	if !req.To.After(req.From) {
+		return nil, ErrInvalidRange
+	}
+
+	var segments []*catalog.Recording
+	for _, rec := range recordings {
+		if req.SessionId != "" && rec.SessionId != req.SessionId {
+			continue
+		}
+		if !rec.EndTime.After(req.From) || !rec.StartTime.Before(req.To) {
+			continue
+		}
+		if _, err := os.Stat(rec.Path); err != nil && !isRemote(rec.Location) {
+			return nil, fmt.Errorf("recording %s is not available: %w", rec.Id, err)
+		}
+		segments = append(segments, rec)
+	}
+	if len(segments) == 0 {
+		return nil, ErrNoRecording
+	}
+	return segments, nil
+}
+
+func isRemote(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// fetch downloads the segments whose local file was removed after the upload
+// to a temporary file next to the recordings, and points their Path at it.
+// It returns the temporary files, to remove once the clip is cut.
+func fetch(segments []*catalog.Recording) ([]string, error) {
+	var fetched []string
+	for _, segment := range segments {
+		if _, err := os.Stat(segment.Path); err == nil {
+			continue
+		}
+
+		path, err := download(segment)
+		if err != nil {
+			for _, path := range fetched {
+				os.Remove(path)
+			}
+			return nil, fmt.Errorf("fetch recording %s failed: %w", segment.Id, err)
+		}
+		logrus.Printf("fetched recording %s from %s for a clip", segment.Id, segment.Location)
+		fetched = append(fetched, path)
+		segment.Path = path
+	}
+	return fetched, nil
+}
+
+func download(segment *catalog.Recording) (string, error) {
+	resp, err := fetchClient.Get(segment.Location)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", segment.Location, resp.Status)
+	}
+
+	fd, err := ioutil.TempFile(*conf.LocalVideoPath, segment.Id+"-*.fetch")
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(fd, hash), resp.Body)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && segment.Sha256 != "" && hex.EncodeToString(hash.Sum(nil)) != segment.Sha256 {
+		err = fmt.Errorf("%s: sha256 mismatch", segment.Location)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+		return "", err
+	}
+	return fd.Name(), nil
+}
+
+// cutter copies the clusters of the range into one webm stream. Timecodes
+// are rewritten so the clip starts at zero and the segments follow each
+// other on their wall-clock time.
+type cutter struct {
+	w        *bufio.Writer
+	from, to time.Time
+
+	started bool
+	start   time.Time
+	end     time.Time
+	scale   uint64
+
+	header  []byte
+	emit    bool
+	cluster time.Time
+}
+
+func cut(rawPath string, segments []*catalog.Recording, from, to time.Time) (*cutter, error) {
+	fd, err := os.Create(rawPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	c := &cutter{w: bufio.NewWriterSize(fd, readChunkSize), from: from, to: to}
+	for _, segment := range segments {
+		done, err := c.copySegment(segment)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+	}
+	if !c.started {
+		return nil, ErrNoRecording
+	}
+
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c, fd.Close()
+}
+
+// copySegment copies the clusters of one segment, it returns true once the
+// end of the range is reached.
+func (c *cutter) copySegment(segment *catalog.Recording) (bool, error) {
+	fd, err := os.Open(segment.Path)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+
+	idx, err := webm.Scan(fd)
+	if err != nil {
+		return false, err
+	}
+	idx.Trim()
+
+	wall := func(timecode int64) time.Time {
+		return segment.StartTime.Add(time.Duration(timecode) * time.Duration(idx.TimecodeScale))
+	}
+
+	// the first segment starts at the last keyframe before the range
+	startOffset := int64(-1)
+	if !c.started {
+		for _, cluster := range idx.Clusters {
+			if !cluster.Keyframe {
+				continue
+			}
+			at := wall(cluster.Timecode)
+			if !at.After(c.from) || startOffset < 0 && at.Before(c.to) {
+				startOffset = cluster.Offset
+			}
+		}
+		if startOffset < 0 {
+			return false, nil
+		}
+	}
+
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	c.emit = false
+	if c.scale == 0 {
+		c.scale = idx.TimecodeScale
+	}
+	p := webm.NewParser(func(el *webm.Element) error {
+		return c.onElement(el, idx, startOffset, wall)
+	})
+
+	buf := make([]byte, readChunkSize)
+	for {
+		n, err := fd.Read(buf)
+		if n > 0 {
+			if _, perr := p.Write(buf[:n]); perr == errDone {
+				return true, nil
+			} else if perr != nil {
+				return false, perr
+			}
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+func (c *cutter) onElement(el *webm.Element, idx *webm.Index, startOffset int64, wall func(int64) time.Time) error {
+	if idx.End > 0 && el.Offset >= idx.End {
+		return nil
+	}
+
+	switch {
+	case el.ID == webm.IDEBML && el.Level == 0:
+		c.header = webm.AppendElement(nil, el.ID, el.Data)
+		c.header = webm.AppendMasterStart(c.header, webm.IDSegment)
+	case el.ID == webm.IDInfo:
+		var info []byte
+		children, _ := webm.Children(el.Data)
+		for _, child := range children {
+			if child.ID != webm.IDDuration {
+				info = webm.AppendElement(info, child.ID, child.Data)
+			}
+		}
+		c.header = webm.AppendElement(c.header, el.ID, info)
+	case el.ID == webm.IDTracks:
+		c.header = webm.AppendElement(c.header, el.ID, el.Data)
+	case el.ID == webm.IDCluster:
+		c.emit = el.Offset >= startOffset
+	case el.ID == webm.IDTimecode && el.Level == 2 && c.emit:
+		c.cluster = wall(int64(webm.ReadUint(el.Data)))
+		if !c.cluster.Before(c.to) {
+			return errDone
+		}
+		if !c.started {
+			if _, err := c.w.Write(c.header); err != nil {
+				return err
+			}
+			c.started = true
+			c.start = c.cluster
+			c.end = c.cluster
+		}
+
+		timecode := uint64(c.cluster.Sub(c.start) / time.Duration(c.scale))
+		b := webm.AppendMasterStart(nil, webm.IDCluster)
+		b = webm.AppendUint(b, webm.IDTimecode, timecode)
+		_, err := c.w.Write(b)
+		return err
+	case (el.ID == webm.IDSimpleBlock || el.ID == webm.IDBlockGroup) && el.Level == 2 && c.emit:
+		var block *webm.Block
+		var err error
+		if el.ID == webm.IDSimpleBlock {
+			block, err = webm.ParseBlock(el.Data)
+		} else {
+			block, err = webm.ParseBlockGroup(el.Data)
+		}
+		if err != nil {
+			return nil
+		}
+
+		at := c.cluster.Add(time.Duration(block.Timecode) * time.Duration(idx.TimecodeScale))
+		if at.After(c.to) {
+			return nil
+		}
+		if at.After(c.end) {
+			c.end = at
+		}
+		_, err = c.w.Write(webm.AppendElement(nil, el.ID, el.Data))
+		return err
+	}
+	return nil
+}
+
+// finalize rewrites the cut stream with a duration and cues.
+func finalize(rawPath, path string) error {
+	src, err := os.Open(rawPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	idx, err := webm.Scan(src)
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(dst, readChunkSize)
+	err = webm.WriteFinal(w, src, idx)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// transcode turns the webm clip into an mp4 with ffmpeg.
+func transcode(webmPath, mp4Path string) error {
+	ffmpeg, err := exec.LookPath(*conf.FfmpegPath)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(ffmpeg, "-hide_banner", "-loglevel", "error", "-y",
+		"-i", webmPath,
+		"-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p",
+		"-c:a", "aac",
+		"-movflags", "+faststart",
+		mp4Path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func digest(path string) (int64, string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer fd.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, fd)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,150 @@
+package clip
+
+import (
+	"bytes"
+	"chrome_render/catalog"
+	"chrome_render/webm"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fixture is a live recorded segment: one video track and a cluster per
+// second with a keyframe at its start and a frame half a second later.
+func fixture(clusters int) []byte {
+	b := webm.AppendElement(nil, webm.IDEBML, webm.AppendElement(nil, 0x4282, []byte("webm")))
+	b = webm.AppendMasterStart(b, webm.IDSegment)
+	b = webm.AppendElement(b, webm.IDInfo, webm.AppendUint(nil, webm.IDTimecodeScale, webm.DefaultTimecodeScale))
+
+	entry := webm.AppendUint(nil, webm.IDTrackNumber, 1)
+	entry = webm.AppendUint(entry, webm.IDTrackType, webm.TrackTypeVideo)
+	entry = webm.AppendElement(entry, webm.IDCodecID, []byte("V_VP8"))
+	b = webm.AppendElement(b, webm.IDTracks, webm.AppendElement(nil, webm.IDTrackEntry, entry))
+
+	for n := 0; n < clusters; n++ {
+		b = webm.AppendMasterStart(b, webm.IDCluster)
+		b = webm.AppendUint(b, webm.IDTimecode, uint64(n*1000))
+		b = webm.AppendElement(b, webm.IDSimpleBlock, []byte{0x81, 0, 0, 0x80, byte(n), 'k'})
+		b = webm.AppendElement(b, webm.IDSimpleBlock, []byte{0x81, 0x01, 0xf4, 0, byte(n), 'd'})
+	}
+	return b
+}
+
+func writeFixture(t *testing.T, id string, start time.Time, clusters int) *catalog.Recording {
+	data := fixture(clusters)
+	path := filepath.Join(t.TempDir(), id+".webm")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	return &catalog.Recording{
+		Id:        id,
+		StartTime: start,
+		EndTime:   start.Add(time.Duration(clusters) * time.Second),
+		Sha256:    hex.EncodeToString(sum[:]),
+		Path:      path,
+		Location:  path,
+	}
+}
+
+func TestCutAcrossSegments(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	segments := []*catalog.Recording{
+		writeFixture(t, "a_1", start, 5),
+		writeFixture(t, "a_2", start.Add(5*time.Second), 5),
+	}
+	from, to := start.Add(2500*time.Millisecond), start.Add(7500*time.Millisecond)
+
+	dir := t.TempDir()
+	rawPath, path := filepath.Join(dir, "clip.webm.cut"), filepath.Join(dir, "clip.webm")
+	c, err := cut(rawPath, segments, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := start.Add(2 * time.Second); !c.start.Equal(want) {
+		t.Errorf("clip starts at %s, want the keyframe at %s", c.start, want)
+	}
+	if !c.end.Equal(to) {
+		t.Errorf("clip ends at %s, want %s", c.end, to)
+	}
+	if err := finalize(rawPath, path); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	idx, err := webm.Scan(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.Truncated {
+		t.Error("clip is truncated")
+	}
+	if len(idx.Clusters) != 6 {
+		t.Fatalf("clip has %d clusters, want 6", len(idx.Clusters))
+	}
+	for n, cluster := range idx.Clusters {
+		if want := int64(n * 1000); cluster.Timecode != want {
+			t.Errorf("cluster %d at %d, want %d", n, cluster.Timecode, want)
+		}
+		if !cluster.Keyframe {
+			t.Errorf("cluster %d lost its keyframe", n)
+		}
+	}
+	if idx.Duration() != 5500 {
+		t.Errorf("clip duration %d, want 5500", idx.Duration())
+	}
+}
+
+func TestFetchUploadedSegment(t *testing.T) {
+	*conf.LocalVideoPath = t.TempDir()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	segment := writeFixture(t, "a_1", start, 3)
+	data, err := ioutil.ReadFile(segment.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	// the local copy is removed once uploaded
+	os.Remove(segment.Path)
+	segment.Location = server.URL + "/recordings/a_1.webm"
+
+	fetched, err := fetch([]*catalog.Recording{segment})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched) != 1 || segment.Path != fetched[0] {
+		t.Fatalf("fetched %v, segment path %s", fetched, segment.Path)
+	}
+	got, err := ioutil.ReadFile(segment.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("fetched segment differs from the upload")
+	}
+	os.Remove(segment.Path)
+
+	segment.Path = filepath.Join(*conf.LocalVideoPath, "a_1.webm")
+	segment.Sha256 = "00"
+	if _, err := fetch([]*catalog.Recording{segment}); err == nil {
+		t.Error("fetched a segment with a wrong checksum")
+	}
+	if left, _ := filepath.Glob(filepath.Join(*conf.LocalVideoPath, "*.fetch")); len(left) > 0 {
+		t.Errorf("temporary files left: %v", left)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
@@ -13,6 +14,12 @@ import (
 
 var conf jsonInfo
 
+var (
+	showVersion *bool
+	configFile  *string
+	dumpConfig  *bool
+)
+
 type jsonInfo struct {
 	LogrusLevel       *string `json:"logrusLevel"`
 	SaveFrameJpg      *bool   `json:"-"`
@@ -34,6 +41,77 @@ type jsonInfo struct {
 	SendReport        *bool   `json:"sendReport"`
 	MaxRecordCount    *int    `json:"maxRecordCount"`
 	HttpAddr          *string `json:"httpAddr"`
+	IngestAddr        *string `json:"ingestAddr"`
+	ResumeTimeout     *int    `json:"resumeTimeout"`
+	MaxMessageSize    *int    `json:"maxMessageSize"`
+	MaxIngestBitRate  *int    `json:"maxIngestBitRate"`
+	WriteBufferSize   *int    `json:"writeBufferSize"`
+	FsyncPolicy       *string `json:"fsyncPolicy"`
+	FsyncInterval     *int    `json:"fsyncInterval"`
+	FfmpegPath        *string `json:"ffmpegPath"`
+	SilenceThreshold  *int    `json:"silenceThreshold"`
+	SilenceAlert      *int    `json:"silenceAlert"`
+	SegmentDuration   *int    `json:"segmentDuration"`
+	StorageType       *string `json:"storageType"`
+	StorageRetries    *int    `json:"storageRetries"`
+	StorageKeepLocal  *bool   `json:"storageKeepLocal"`
+	S3Endpoint        *string `json:"s3Endpoint"`
+	S3Region          *string `json:"s3Region"`
+	S3Bucket          *string `json:"s3Bucket"`
+	S3AccessKey       *string `json:"s3AccessKey"`
+	S3SecretKey       *string `json:"s3SecretKey"`
+	S3Prefix          *string `json:"s3Prefix"`
+	S3PathStyle       *bool   `json:"s3PathStyle"`
+	S3PartSize        *int    `json:"s3PartSize"`
+	UploadChunkSize   *int    `json:"uploadChunkSize"`
+	CatalogPath       *string `json:"catalogPath"`
+	DiskQuota         *int    `json:"diskQuota"`
+	TaskDiskQuota     *int    `json:"taskDiskQuota"`
+	MinFreeSpace      *int    `json:"minFreeSpace"`
+	DiskCheckInterval *int    `json:"diskCheckInterval"`
+	HlsPath           *string `json:"hlsPath"`
+	HlsWindow         *int    `json:"hlsWindow"`
+	HlsSegment        *int    `json:"hlsSegment"`
+	HlsLiveSize       *int    `json:"hlsLiveSize"`
+	ThumbnailPath     *string `json:"thumbnailPath"`
+	ThumbnailInterval *int    `json:"thumbnailInterval"`
+	ThumbnailWidth    *int    `json:"thumbnailWidth"`
+	SpriteColumns     *int    `json:"spriteColumns"`
+	SpriteRows        *int    `json:"spriteRows"`
+	Overlay           *bool   `json:"overlay"`
+	OverlayPosition   *string `json:"overlayPosition"`
+	OverlayOpacity    *int    `json:"overlayOpacity"`
+	OverlayScale      *int    `json:"overlayScale"`
+	Watermark         *string `json:"watermark"`
+	WatermarkPosition *string `json:"watermarkPosition"`
+	WatermarkOpacity  *int    `json:"watermarkOpacity"`
+	DomOverlay        *string `json:"domOverlay"`
+	XvfbPath          *string `json:"xvfbPath"`
+	XvfbDepth         *int    `json:"xvfbDepth"`
+	DisplayBase       *int    `json:"displayBase"`
+	ChromeMode        *string `json:"chromeMode"`
+	PactlPath         *string `json:"pactlPath"`
+	ScreencastEncode  *bool   `json:"screencastEncode"`
+	ExtensionPath     *string `json:"extensionPath"`
+	EmbeddedExtension *bool   `json:"embeddedExtension"`
+	ProfilePath       *string `json:"profilePath"`
+	ProfileTemplate   *string `json:"profileTemplate"`
+	KeepProfile       *bool   `json:"keepProfile"`
+	ChromePath        *string `json:"chromePath"`
+	DefaultFlags      *string `json:"defaultFlags"`
+	ChromeFlags       *string `json:"chromeFlags"`
+	ChromeNoFlags     *string `json:"chromeNoFlags"`
+	ProxyServer       *string `json:"proxyServer"`
+	ProxyBypass       *string `json:"proxyBypass"`
+	UserAgent         *string `json:"userAgent"`
+	WindowSize        *string `json:"windowSize"`
+	ChromeOptions     *string `json:"chromeOptions"`
+	PidDir            *string `json:"pidDir"`
+	CgroupRoot        *string `json:"cgroupRoot"`
+	TaskCpu           *int    `json:"taskCpu"`
+	TaskMemory        *int    `json:"taskMemory"`
+	PoolSize          *int    `json:"poolSize"`
+	PoolMaxUses       *int    `json:"poolMaxUses"`
 }
 
 func init() {
@@ -51,15 +129,85 @@ func init() {
 	videoHeight := flag.Int("height", 720, "video height")
 	maxRecordCount := flag.Int("max-record-count", 0, "maximum number of concurrent recording streams")
 	schedulingServer := flag.String("ws", "ws://127.0.0.1:8080", "scheduling server ws address")
-	recordDomainAddr := flag.String("record-domain", "http://127.0.0.1/", "record domain url")
+	recordDomainAddr := flag.String("record-domain", "", "record domain url the recordings are uploaded to, the default storage when set")
 	renderDomainUrl := flag.String("domain-url", "http://127.0.0.1/", "render page url")
 	monitorCenterUrl := flag.String("monitor-url", "http://127.0.0.1:3000/", "monitor center server address")
 	httpAddr := flag.String("http-addr", ":9999", "http listen on host:port")
+	ingestAddr := flag.String("ingest-addr", "localhost:8080", "ingest websocket listen on host:port, the extensions stream to it and live viewers watch on its /live")
+	resumeTimeout := flag.Int("resume-timeout", 30, "seconds to keep a recording open waiting for the extension to reconnect")
+	maxMessageSize := flag.Int("max-message-size", 16, "maximum size of one ingest websocket message, MB")
+	maxIngestBitRate := flag.Int("max-ingest-bitrate", 0, "throttle an ingest connection above this rate, kb/s, 0 is unlimited")
+	writeBufferSize := flag.Int("write-buffer", 256, "recording write buffer size, KB")
+	fsyncPolicy := flag.String("fsync", "interval", "recording fsync policy: never, interval, always")
+	fsyncInterval := flag.Int("fsync-interval", 5, "seconds between recording fsyncs with the interval policy")
+	ffmpegPath := flag.String("ffmpeg", "ffmpeg", "ffmpeg binary used to decode recordings and transcode clips")
+	silenceThreshold := flag.Int("silence-threshold", -60, "audio below this level is silence, dBFS")
+	silenceAlert := flag.Int("silence-alert", 10, "seconds of silence before the task is alerted")
+	segmentDuration := flag.Int("segment-duration", 0, "rotate recordings into segments of this many seconds, 0 is one file per session")
+	storageType := flag.String("storage", "", "storage of recordings and frames: local keeps them on disk, s3, or record-domain uploads them to -record-domain, empty is record-domain when -record-domain is set and local otherwise")
+	storageRetries := flag.Int("storage-retries", 5, "upload retries before a file is kept locally")
+	storageKeepLocal := flag.Bool("storage-keep-local", false, "keep local copies of uploaded files")
+	s3Endpoint := flag.String("s3-endpoint", "", "s3 compatible endpoint, e.g. http://127.0.0.1:9000")
+	s3Region := flag.String("s3-region", "us-east-1", "s3 region")
+	s3Bucket := flag.String("s3-bucket", "", "s3 bucket")
+	s3AccessKey := flag.String("s3-access-key", "", "s3 access key")
+	s3SecretKey := flag.String("s3-secret-key", "", "s3 secret key")
+	s3Prefix := flag.String("s3-prefix", "", "s3 object key prefix")
+	s3PathStyle := flag.Bool("s3-path-style", true, "use path style s3 urls instead of virtual hosts")
+	s3PartSize := flag.Int("s3-part-size", 8, "s3 multipart upload part size, MB")
+	uploadChunkSize := flag.Int("upload-chunk-size", 4, "record domain resumable upload chunk size, MB")
+	catalogPath := flag.String("catalog", "./videos/catalog.json", "recording catalog file")
+	diskQuota := flag.Int("disk-quota", 0, "maximum size of all recordings and frames, MB, 0 is unlimited")
+	taskDiskQuota := flag.Int("task-disk-quota", 0, "maximum size of the recordings and frames of one task, MB, 0 is unlimited")
+	minFreeSpace := flag.Int("min-free-space", 0, "minimum free disk space, MB, recordings are paused then stopped below it, 0 is unchecked")
+	diskCheckInterval := flag.Int("disk-check-interval", 10, "seconds between disk usage checks, 0 disables the guard")
+	hlsPath := flag.String("hls-path", "./videos/hls/", "a local dir path for hls segments, one dir per task")
+	hlsWindow := flag.Int("hls-window", 0, "hls time-shift window, minutes, 0 disables hls")
+	hlsSegment := flag.Int("hls-segment", 4, "hls segment duration, seconds")
+	hlsLiveSize := flag.Int("hls-live-size", 6, "segments in the hls live playlist")
+	thumbnailPath := flag.String("thumbnail-path", "./videos/thumbnails/", "a local dir path for thumbnail sprites, one dir per recording")
+	thumbnailInterval := flag.Int("thumbnail-interval", 0, "seconds between recording thumbnails, 0 disables thumbnails. They are taken from the screencast frames, a task without a screencast has its recordings decoded by ffmpeg")
+	thumbnailWidth := flag.Int("thumbnail-width", 160, "thumbnail width, the height follows the video aspect ratio")
+	spriteColumns := flag.Int("sprite-columns", 10, "thumbnails per sprite row")
+	spriteRows := flag.Int("sprite-rows", 10, "thumbnail rows per sprite")
+	overlay := flag.Bool("overlay", false, "draw the time and task name onto the page frames")
+	overlayPosition := flag.String("overlay-position", "bottom-right", "corner of the time overlay: top-left, top-right, bottom-left, bottom-right")
+	overlayOpacity := flag.Int("overlay-opacity", 80, "opacity of the time overlay, percent")
+	overlayScale := flag.Int("overlay-scale", 2, "pixel size of the time overlay font")
+	watermark := flag.String("watermark", "", "a png drawn onto the page frames")
+	watermarkPosition := flag.String("watermark-position", "top-right", "corner of the watermark: top-left, top-right, bottom-left, bottom-right")
+	watermarkOpacity := flag.Int("watermark-opacity", 50, "opacity of the watermark, percent")
+	domOverlay := flag.String("dom-overlay", "", "json file of the in-page overlay elements by task name, a clock when empty")
+	xvfbPath := flag.String("xvfb", "Xvfb", "Xvfb binary, every task runs its chrome on its own display")
+	xvfbDepth := flag.Int("xvfb-depth", 24, "Xvfb screen color depth")
+	displayBase := flag.Int("display-base", 99, "first x display number given to tasks")
+	chromeMode := flag.String("mode", "record", "default chrome mode of tasks: record with the extension on a display, screencast headless frames only, or shared to screencast as a tab of one browser shared by the shared tasks")
+	pactlPath := flag.String("pactl", "pactl", "pactl binary used to give every task its own pulseaudio null sink, empty disables it")
+	screencastEncode := flag.Bool("screencast-encode", false, "encode the frames and the sink audio of screencast tasks into a recording with ffmpeg")
+	extensionPath := flag.String("extension-path", "crx", "directory of the recorder extension, a relative path is resolved from the directory of the binary")
+	embeddedExtension := flag.Bool("embedded-extension", false, "load the recorder extension embedded in the binary instead of extension-path")
+	profilePath := flag.String("profile-path", "", "directory the chrome profiles of the tasks are created in, empty is the system temp directory")
+	profileTemplate := flag.String("profile-template", "", "chrome profile copied into the profile of every task")
+	keepProfile := flag.Bool("keep-profile", false, "keep the chrome profile of a task after it exits")
+	chromePath := flag.String("chrome", "", "chrome binary, empty looks up the usual names")
+	defaultFlags := flag.String("chrome-default-flags", "disable-web-security,auto-open-devtools-for-tabs", "comma separated chrome flags every browser starts with, as name or name=value, before chrome-flags and chrome-no-flags apply. A value may hold commas, e.g. disable-features=A,B")
+	chromeFlags := flag.String("chrome-flags", "", "comma separated chrome flags added to the defaults, as name or name=value. A value may hold commas, e.g. enable-features=A,B")
+	chromeNoFlags := flag.String("chrome-no-flags", "", "comma separated default chrome flags to leave out, e.g. disable-web-security")
+	proxyServer := flag.String("proxy-server", "", "proxy server of chrome, e.g. socks5://127.0.0.1:1080")
+	proxyBypass := flag.String("proxy-bypass", "", "comma separated hosts chrome reaches without the proxy")
+	userAgent := flag.String("user-agent", "", "user agent of chrome, empty keeps the default one")
+	windowSize := flag.String("window-size", "", "chrome window size as WIDTHxHEIGHT, empty is the size of the task")
+	chromeOptions := flag.String("chrome-options", "", "json file of the chrome options by task name, overriding the chrome flags")
+	pidDir := flag.String("pid-dir", "./run/", "directory of the pid files of chrome and xvfb, orphans left in it are killed at startup")
+	cgroupRoot := flag.String("cgroup-root", "", "cgroup v2 directory the task cgroups are created in, e.g. /sys/fs/cgroup/chrome_render, empty disables them. It and its parent must be delegated to the service and hold no other process")
+	taskCpu := flag.Int("task-cpu", 0, "cpu quota of a task, percent of one core, 0 is unlimited")
+	taskMemory := flag.Int("task-memory", 0, "memory limit of a task, MB, 0 is unlimited")
+	poolSize := flag.Int("pool-size", 0, "idle browsers launched ahead for new tasks of the default size, 0 disables the pool")
+	poolMaxUses := flag.Int("pool-max-uses", 10, "tasks a pooled browser serves before it is replaced by a new one")
 	sendReport := flag.Bool("report", true, "send record report to scheduling server")
-	showVersion := flag.Bool("v", false, "current version")
-	configFile := flag.String("c", "", "read config from specified file")
-	dumpConfig := flag.Bool("dump-config", false, "dump default config")
-	flag.Parse()
+	showVersion = flag.Bool("v", false, "current version")
+	configFile = flag.String("c", "", "read config from specified file")
+	dumpConfig = flag.Bool("dump-config", false, "dump default config")
 
 	conf.LogrusLevel = logLevel
 	conf.FrameJpgPath = frameJpgPath
@@ -80,6 +228,86 @@ func init() {
 	conf.SendReport = sendReport
 	conf.MaxRecordCount = maxRecordCount
 	conf.HttpAddr = httpAddr
+	conf.IngestAddr = ingestAddr
+	conf.ResumeTimeout = resumeTimeout
+	conf.MaxMessageSize = maxMessageSize
+	conf.MaxIngestBitRate = maxIngestBitRate
+	conf.WriteBufferSize = writeBufferSize
+	conf.FsyncPolicy = fsyncPolicy
+	conf.FsyncInterval = fsyncInterval
+	conf.FfmpegPath = ffmpegPath
+	conf.SilenceThreshold = silenceThreshold
+	conf.SilenceAlert = silenceAlert
+	conf.SegmentDuration = segmentDuration
+	conf.StorageType = storageType
+	conf.StorageRetries = storageRetries
+	conf.StorageKeepLocal = storageKeepLocal
+	conf.S3Endpoint = s3Endpoint
+	conf.S3Region = s3Region
+	conf.S3Bucket = s3Bucket
+	conf.S3AccessKey = s3AccessKey
+	conf.S3SecretKey = s3SecretKey
+	conf.S3Prefix = s3Prefix
+	conf.S3PathStyle = s3PathStyle
+	conf.S3PartSize = s3PartSize
+	conf.UploadChunkSize = uploadChunkSize
+	conf.CatalogPath = catalogPath
+	conf.DiskQuota = diskQuota
+	conf.TaskDiskQuota = taskDiskQuota
+	conf.MinFreeSpace = minFreeSpace
+	conf.DiskCheckInterval = diskCheckInterval
+	conf.HlsPath = hlsPath
+	conf.HlsWindow = hlsWindow
+	conf.HlsSegment = hlsSegment
+	conf.HlsLiveSize = hlsLiveSize
+	conf.ThumbnailPath = thumbnailPath
+	conf.ThumbnailInterval = thumbnailInterval
+	conf.ThumbnailWidth = thumbnailWidth
+	conf.SpriteColumns = spriteColumns
+	conf.SpriteRows = spriteRows
+	conf.Overlay = overlay
+	conf.OverlayPosition = overlayPosition
+	conf.OverlayOpacity = overlayOpacity
+	conf.OverlayScale = overlayScale
+	conf.Watermark = watermark
+	conf.WatermarkPosition = watermarkPosition
+	conf.WatermarkOpacity = watermarkOpacity
+	conf.DomOverlay = domOverlay
+	conf.XvfbPath = xvfbPath
+	conf.XvfbDepth = xvfbDepth
+	conf.DisplayBase = displayBase
+	conf.ChromeMode = chromeMode
+	conf.PactlPath = pactlPath
+	conf.ScreencastEncode = screencastEncode
+	conf.ExtensionPath = extensionPath
+	conf.EmbeddedExtension = embeddedExtension
+	conf.ProfilePath = profilePath
+	conf.ProfileTemplate = profileTemplate
+	conf.KeepProfile = keepProfile
+	conf.ChromePath = chromePath
+	conf.DefaultFlags = defaultFlags
+	conf.ChromeFlags = chromeFlags
+	conf.ChromeNoFlags = chromeNoFlags
+	conf.ProxyServer = proxyServer
+	conf.ProxyBypass = proxyBypass
+	conf.UserAgent = userAgent
+	conf.WindowSize = windowSize
+	conf.ChromeOptions = chromeOptions
+	conf.PidDir = pidDir
+	conf.CgroupRoot = cgroupRoot
+	conf.TaskCpu = taskCpu
+	conf.TaskMemory = taskMemory
+	conf.PoolSize = poolSize
+	conf.PoolMaxUses = poolMaxUses
+
+	saveFrameJpg := false
+	conf.SaveFrameJpg = &saveFrameJpg
+}
+
+// Load parses the command line and the config file, main calls it before
+// anything reads the config, the packages only see the defaults until then.
+func Load() {
+	flag.Parse()
 
 	if *configFile != "" {
 		ReadConfig(*configFile)
@@ -125,11 +353,44 @@ func ReadConfig(configFile string) {
 	}
 }
 
+// MarshalConfig is the config as json for the logs, with the credentials
+// redacted.
 func MarshalConfig() string {
-	str, _ := json.MarshalIndent(conf, "", "  ")
+	c := conf
+	c.S3SecretKey = redact(c.S3SecretKey)
+	c.ProxyServer = redactUrl(c.ProxyServer)
+	c.RecordDomainAddr = redactUrl(c.RecordDomainAddr)
+	c.SchedulingServer = redactUrl(c.SchedulingServer)
+	c.MonitorCenterUrl = redactUrl(c.MonitorCenterUrl)
+	c.S3Endpoint = redactUrl(c.S3Endpoint)
+	str, _ := json.MarshalIndent(c, "", "  ")
 	return string(str)
 }
 
+const redacted = "******"
+
+func redact(value *string) *string {
+	if value == nil || *value == "" {
+		return value
+	}
+	s := redacted
+	return &s
+}
+
+// redactUrl hides the password of a url with user info, such as a proxy
+// with credentials.
+func redactUrl(value *string) *string {
+	if value == nil {
+		return value
+	}
+	u, err := url.Parse(*value)
+	if err != nil {
+		return value
+	}
+	s := u.Redacted()
+	return &s
+}
+
 func GetConfig() *jsonInfo {
 	return &conf
 }
@@ -0,0 +1,10 @@
+// Package crx embeds the recorder extension, so a binary copied alone to a
+// machine can still load it.
+package crx
+
+import "embed"
+
+// Files are the files of the extension, rooted at the extension directory.
+//
+//go:embed manifest.json background.html v-icon.png js
+var Files embed.FS
@@ -8,7 +8,7 @@ chrome.browserAction.onClicked.addListener(function () {
 //   (function fn(tab) {
 //     alert(tab.status)
 //     if (tab.status == "complete") {
-setTimeout(captureTab, 1000)
+// setTimeout(captureTab, 1000)
 //     } else {
 //       setTimeout(fn.bind(null, tab), 1000)
 //     }
@@ -16,12 +16,135 @@ setTimeout(captureTab, 1000)
 // });
 
 
-const ws = new WebSocket("ws://127.0.0.1:8080")
-ws.binaryType = 'arraybuffer';
+// The session id lets the server continue the same recording when the
+// websocket reconnects; every new connection restarts the MediaRecorder so
+// the server always receives a complete webm stream.
+const sessionId = Date.now().toString(36) + Math.random().toString(36).slice(2, 8);
 
+var ws = null;
+var captureStream = null;
+var recorder = null;
 var recordedChunks = [];
+var recordedCount = 0;
+var recordedBytes = 0;
+var reconnectDelay = 1000;
+
+// Replaced by the options of the start command sent by the server.
+var captureOptions = {
+    videoBitsPerSecond: 1000 * 1000,
+    audioBitsPerSecond: 64 * 1000,
+    frameRate: 15,
+    width: 1280
+};
+
+function connect() {
+    ws = new WebSocket(INGEST_URL + "?task=" + encodeURIComponent(TASK_NAME) + "&session=" + sessionId);
+    ws.binaryType = 'arraybuffer';
+
+    ws.onopen = function () {
+        if (captureStream) {
+            startRecorder();
+        }
+    };
+
+    ws.onclose = function (event) {
+        stopRecorder();
+        // the server closes with 1011 when it can't write the recording,
+        // e.g. the disk is full, so retry slower and slower
+        reconnectDelay = event.code === 1011 ? Math.min(reconnectDelay * 2, 60000) : 1000;
+        setTimeout(connect, reconnectDelay);
+    };
+
+    ws.onmessage = function (event) {
+        if (typeof event.data === 'string') {
+            handleCommand(JSON.parse(event.data));
+        }
+    };
+}
+
+// a browser waiting in the pool has no task yet, the launcher writes it
+// and reloads this page when a task claims the browser
+if (TASK_NAME) {
+    connect();
+}
+setInterval(sendStats, 5000);
+
+function sendMessage(message) {
+    if (ws && ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify(message));
+    }
+}
+
+function sendAck(cmd, error) {
+    sendMessage({type: "ack", id: cmd.id, ok: !error, error: error || ""});
+}
+
+function sendStats() {
+    sendMessage({
+        type: "stats",
+        state: recorder ? recorder.state : "inactive",
+        mimeType: recorder ? recorder.mimeType : "",
+        videoBitsPerSecond: recorder ? recorder.videoBitsPerSecond : 0,
+        audioBitsPerSecond: recorder ? recorder.audioBitsPerSecond : 0,
+        chunks: recordedCount,
+        bytes: recordedBytes
+    });
+}
+
+function applyOptions(cmd) {
+    ["videoBitsPerSecond", "audioBitsPerSecond", "frameRate", "width", "height"].forEach(function (key) {
+        if (cmd[key]) {
+            captureOptions[key] = cmd[key];
+        }
+    });
+}
+
+// Commands sent by the server, every one is answered with an ack.
+function handleCommand(cmd) {
+    if (cmd.type !== "command") {
+        return;
+    }
+
+    switch (cmd.action) {
+        case "start":
+            applyOptions(cmd);
+            stopCapture();
+            captureTab(function (error) {
+                sendAck(cmd, error);
+            });
+            return;
+        case "stop":
+            stopCapture();
+            break;
+        case "pause":
+            if (!recorder || recorder.state !== "recording") {
+                return sendAck(cmd, "recorder is not recording");
+            }
+            recorder.pause();
+            break;
+        case "resume":
+            if (!recorder || recorder.state !== "paused") {
+                return sendAck(cmd, "recorder is not paused");
+            }
+            recorder.resume();
+            break;
+        case "set-bitrate":
+            applyOptions(cmd);
+            if (captureStream) {
+                // MediaRecorder can't change bitrate while running
+                startRecorder();
+            }
+            break;
+        default:
+            return sendAck(cmd, "unknown action: " + cmd.action);
+    }
+
+    sendAck(cmd);
+}
+
+function captureTab(callback) {
+    callback = callback || function () {};
 
-function captureTab() {
     const constraints = {
         audio: true,
         video: true,
@@ -34,9 +157,9 @@ function captureTab() {
         videoConstraints: {
             mandatory: {
                 chromeMediaSource: 'tab',
-                maxWidth: 1280,
-                minWidth: 1280,
-                maxFrameRate: 15,
+                maxWidth: captureOptions.width,
+                minWidth: captureOptions.width,
+                maxFrameRate: captureOptions.frameRate,
                 minAspectRatio: 1.77,
 
             }
@@ -46,6 +169,7 @@ function captureTab() {
     chrome.tabCapture.capture(constraints, function (stream) {
         if (!stream) {
             console.error("couldn't record tab");
+            callback("couldn't record tab: " + (chrome.runtime.lastError ? chrome.runtime.lastError.message : ""));
             return;
         }
         const originalAudioTrack = stream.getAudioTracks()[0];
@@ -65,14 +189,11 @@ function captureTab() {
         stream.removeTrack(originalAudioTrack)
 
 
-        const recorder = new MediaRecorder(stream, {
-            mimeType: 'video/webm',
-            videoBitsPerSecond:  1000 * 1000,
-            audioBitsPerSecond:  64 * 1000
-        });
-
-        recorder.start(1000);
-        recorder.ondataavailable = handleDataAvailable
+        captureStream = stream;
+        if (ws && ws.readyState === WebSocket.OPEN) {
+            startRecorder();
+        }
+        callback();
 
         // setTimeout(event => {
         //     console.log("stopping");
@@ -81,12 +202,48 @@ function captureTab() {
     });
 }
 
+function startRecorder() {
+    stopRecorder();
+
+    recorder = new MediaRecorder(captureStream, {
+        mimeType: 'video/webm',
+        videoBitsPerSecond: captureOptions.videoBitsPerSecond,
+        audioBitsPerSecond: captureOptions.audioBitsPerSecond
+    });
+
+    recorder.start(1000);
+    recorder.ondataavailable = handleDataAvailable
+}
+
+function stopRecorder() {
+    if (recorder && recorder.state !== 'inactive') {
+        recorder.ondataavailable = null;
+        recorder.stop();
+    }
+    recorder = null;
+}
+
+function stopCapture() {
+    stopRecorder();
+    if (captureStream) {
+        captureStream.getTracks().forEach(function (track) {
+            track.stop();
+        });
+        captureStream = null;
+    }
+}
+
 function handleDataAvailable(event) {
   console.log("data-available");
 
   if (event.data.size > 0) {
+      recordedCount++;
+      recordedBytes += event.data.size;
+      const socket = ws;
       blobToArrayBufferConverter([event.data], (arrBuffer) => {
-          ws.send(arrBuffer);
+          if (socket === ws && socket.readyState === WebSocket.OPEN) {
+              socket.send(arrBuffer);
+          }
       })
     // recordedChunks.push(event.data);
     // console.log(recordedChunks);
@@ -0,0 +1,3 @@
+// Overwritten by the launcher with the task this browser records for.
+const TASK_NAME = "default";
+const INGEST_URL = "ws://127.0.0.1:8080";
@@ -0,0 +1,216 @@
+package hls
+
+import (
+	"chrome_render/config"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var conf = config.GetConfig()
+
+// Segment is one media segment of a window.
+type Segment struct {
+	Name          string
+	Duration      float64
+	Time          time.Time
+	Discontinuity bool
+}
+
+// window is the time-shift window of a task. It outlives the recordings
+// feeding it; the first segment of every new recording is marked as a
+// discontinuity, and the playlists end while no recording feeds it.
+type window struct {
+	lock sync.Mutex
+
+	taskName      string
+	dir           string
+	segments      []*Segment
+	sequence      int
+	discontinuity int
+	writers       int
+	idleSince     time.Time
+}
+
+var (
+	windowsLock sync.Mutex
+	windows     = map[string]*window{}
+)
+
+// Enabled reports whether hls output is configured.
+func Enabled() bool {
+	return *conf.HlsWindow > 0
+}
+
+func getWindow(taskName string) *window {
+	windowsLock.Lock()
+	defer windowsLock.Unlock()
+
+	return windows[taskName]
+}
+
+// attachWindow returns the window of the task for a new writer, creating it
+// when the task has none.
+func attachWindow(taskName string) *window {
+	windowsLock.Lock()
+	defer windowsLock.Unlock()
+
+	w, ok := windows[taskName]
+	if !ok {
+		w = &window{
+			taskName: taskName,
+			dir:      filepath.Join(*conf.HlsPath, taskName),
+		}
+		// segments of a previous run are not listed anymore
+		if err := os.RemoveAll(w.dir); err != nil {
+			logrus.WithError(err).Warnf("clean hls dir %s failed", w.dir)
+		}
+		windows[taskName] = w
+	}
+
+	w.lock.Lock()
+	w.writers++
+	w.lock.Unlock()
+	return w
+}
+
+// detach ends a writer of the window. A window left without writers is
+// removed once its last segments are out of the window.
+func (w *window) detach() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.writers--
+	if w.writers == 0 {
+		w.idleSince = time.Now()
+		time.AfterFunc(windowDuration(), w.expire)
+	}
+}
+
+func (w *window) expire() {
+	windowsLock.Lock()
+	defer windowsLock.Unlock()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.writers > 0 || time.Since(w.idleSince) < windowDuration() || windows[w.taskName] != w {
+		return
+	}
+	delete(windows, w.taskName)
+	if err := os.RemoveAll(w.dir); err != nil {
+		logrus.WithError(err).Warnf("remove hls dir %s failed", w.dir)
+	}
+	logrus.Printf("hls window closed. task name: %s", w.taskName)
+}
+
+func windowDuration() time.Duration {
+	return time.Duration(*conf.HlsWindow) * time.Minute
+}
+
+func (w *window) add(seg *Segment) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.segments = append(w.segments, seg)
+	w.prune()
+}
+
+// prune removes the segments which left the window.
+func (w *window) prune() {
+	limit := time.Now().Add(-windowDuration())
+
+	for len(w.segments) > 0 && w.segments[0].Time.Add(time.Duration(w.segments[0].Duration*float64(time.Second))).Before(limit) {
+		seg := w.segments[0]
+		if err := os.Remove(filepath.Join(w.dir, seg.Name)); err != nil && !os.IsNotExist(err) {
+			logrus.WithError(err).Warnf("remove hls segment %s failed", seg.Name)
+		}
+		w.segments = w.segments[1:]
+		w.sequence++
+		if seg.Discontinuity {
+			w.discontinuity++
+		}
+	}
+}
+
+// playlist renders the media playlist of the window. The live playlist has
+// the last segments only, the event playlist the whole window so players
+// can seek back.
+func (w *window) playlist(live bool) string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.prune()
+
+	segments := w.segments
+	sequence := w.sequence
+	discontinuity := w.discontinuity
+	if live && len(segments) > *conf.HlsLiveSize {
+		skip := len(segments) - *conf.HlsLiveSize
+		for _, seg := range segments[:skip] {
+			if seg.Discontinuity {
+				discontinuity++
+			}
+		}
+		segments = segments[skip:]
+		sequence += skip
+	}
+
+	target := *conf.HlsSegment
+	for _, seg := range segments {
+		if d := int(math.Ceil(seg.Duration)); d > target {
+			target = d
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	if !live {
+		b.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", target)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", sequence)
+	fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuity)
+	for _, seg := range segments {
+		if seg.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.Time.UTC().Format("2006-01-02T15:04:05.000Z"))
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", seg.Duration, seg.Name)
+	}
+	if w.writers == 0 {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.String()
+}
+
+// Playlist returns the live or event playlist of the task.
+func Playlist(taskName string, live bool) (string, bool) {
+	w := getWindow(taskName)
+	if w == nil {
+		return "", false
+	}
+	return w.playlist(live), true
+}
+
+// SegmentPath returns the file of a segment still in the window of the task.
+func SegmentPath(taskName, name string) (string, bool) {
+	w := getWindow(taskName)
+	if w == nil {
+		return "", false
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for _, seg := range w.segments {
+		if seg.Name == name {
+			return filepath.Join(w.dir, name), true
+		}
+	}
+	return "", false
+}
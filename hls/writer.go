@@ -0,0 +1,224 @@
+package hls
+
+import (
+	"bufio"
+	"chrome_render/webm"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const writeQueueSize = 1024
+
+// Writer transcodes the webm stream of one recording into the segments of
+// the window of its task. Without hls configured, or without ffmpeg, it
+// drops what it is given.
+type Writer struct {
+	lock sync.Mutex
+
+	taskName string
+	window   *window
+	cmd      *exec.Cmd
+	chData   chan []byte
+	first    bool
+
+	// after an overflow elements are dropped up to the next cluster
+	// starting with a keyframe, which is queued whole with its header
+	dropped int
+	resync  []byte
+}
+
+// NewWriter starts the segmenter of a new recording of the task.
+func NewWriter(taskName string) *Writer {
+	w := &Writer{taskName: taskName}
+	if !Enabled() {
+		return w
+	}
+
+	path, err := exec.LookPath(*conf.FfmpegPath)
+	if err != nil {
+		logrus.WithError(err).Warnf("ffmpeg not found, no hls output. task name: %s", taskName)
+		return w
+	}
+
+	win := attachWindow(taskName)
+	if err := os.MkdirAll(win.dir, 0755); err != nil {
+		logrus.WithError(err).Errorf("create hls dir failed. task name: %s", taskName)
+		win.detach()
+		return w
+	}
+
+	segment := strconv.Itoa(*conf.HlsSegment)
+	pattern := filepath.Join(win.dir, fmt.Sprintf("%d_%%06d.ts", time.Now().Unix()))
+	cmd := exec.Command(path, "-hide_banner", "-loglevel", "error",
+		"-f", "webm", "-i", "pipe:0",
+		"-map", "0:v?", "-map", "0:a?",
+		"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency", "-pix_fmt", "yuv420p",
+		"-force_key_frames", "expr:gte(t,n_forced*"+segment+")",
+		"-c:a", "aac",
+		"-f", "segment", "-segment_format", "mpegts", "-segment_time", segment,
+		"-segment_list", "pipe:3", "-segment_list_type", "csv", "-segment_list_flags", "+live",
+		pattern)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		logrus.WithError(err).Errorf("start hls segmenter failed. task name: %s", taskName)
+		win.detach()
+		return w
+	}
+	listReader, listWriter, err := os.Pipe()
+	if err != nil {
+		logrus.WithError(err).Errorf("start hls segmenter failed. task name: %s", taskName)
+		win.detach()
+		return w
+	}
+	cmd.ExtraFiles = []*os.File{listWriter}
+	err = cmd.Start()
+	listWriter.Close()
+	if err != nil {
+		listReader.Close()
+		logrus.WithError(err).Errorf("start hls segmenter failed. task name: %s", taskName)
+		win.detach()
+		return w
+	}
+
+	win.lock.Lock()
+	w.first = win.sequence > 0 || len(win.segments) > 0
+	win.lock.Unlock()
+
+	w.window = win
+	w.cmd = cmd
+	w.chData = make(chan []byte, writeQueueSize)
+	go w.writeLoop(stdin, w.chData)
+	go w.readLoop(listReader)
+	return w
+}
+
+// Write queues a webm element rather than blocking the recording. When
+// ffmpeg falls behind the stream is cut at element boundaries and resumes at
+// the next keyframe cluster, so ffmpeg still reads a valid webm stream.
+func (w *Writer) Write(id uint32, b []byte) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.chData == nil {
+		return
+	}
+
+	if w.dropped > 0 {
+		if b = w.resynchronize(id, b); b == nil {
+			return
+		}
+	}
+
+	select {
+	case w.chData <- b:
+		if w.dropped > 0 {
+			logrus.Warnf("hls segmenter resumed at a keyframe cluster, %d elements dropped. task name: %s", w.dropped, w.taskName)
+			w.dropped = 0
+		}
+	default:
+		if w.dropped == 0 {
+			logrus.Warnf("hls segmenter queue is full, dropping up to the next keyframe. task name: %s", w.taskName)
+		}
+		w.dropped++
+		w.resync = nil
+	}
+}
+
+// resynchronize holds the start of a cluster until its first block, it
+// returns the cluster up to that block once it is a keyframe and nil while
+// elements are still dropped.
+func (w *Writer) resynchronize(id uint32, b []byte) []byte {
+	switch {
+	case id == webm.IDCluster:
+		w.resync = append([]byte(nil), b...)
+		return nil
+	case w.resync == nil:
+	case id == webm.IDTimecode:
+		w.resync = append(w.resync, b...)
+		return nil
+	case id == webm.IDSimpleBlock:
+		if block, err := parseSimpleBlock(b); err == nil && block.Keyframe() {
+			return append(w.resync, b...)
+		}
+		w.resync = nil
+	default:
+		w.resync = nil
+	}
+	w.dropped++
+	return nil
+}
+
+func parseSimpleBlock(b []byte) (*webm.Block, error) {
+	_, _, n, err := webm.ReadElementHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	return webm.ParseBlock(b[n:])
+}
+
+// Close ends the stream, ffmpeg then finishes the last segment.
+func (w *Writer) Close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.chData != nil {
+		close(w.chData)
+		w.chData = nil
+	}
+}
+
+func (w *Writer) writeLoop(stdin io.WriteCloser, chData chan []byte) {
+	defer stdin.Close()
+
+	for b := range chData {
+		if _, err := stdin.Write(b); err != nil {
+			logrus.WithError(err).Warnf("write hls segmenter failed. task name: %s", w.taskName)
+			for range chData {
+			}
+			return
+		}
+	}
+}
+
+// readLoop adds the segments ffmpeg lists as name,start,end once they are
+// complete.
+func (w *Writer) readLoop(r io.ReadCloser) {
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		if len(fields) < 3 {
+			continue
+		}
+		start, err1 := strconv.ParseFloat(fields[len(fields)-2], 64)
+		end, err2 := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		duration := end - start
+		w.window.add(&Segment{
+			Name:          filepath.Base(strings.Join(fields[:len(fields)-2], ",")),
+			Duration:      duration,
+			Time:          time.Now().Add(-time.Duration(duration * float64(time.Second))),
+			Discontinuity: w.first,
+		})
+		w.first = false
+	}
+
+	if err := w.cmd.Wait(); err != nil {
+		logrus.WithError(err).Warnf("hls segmenter exited. task name: %s", w.taskName)
+	}
+
+	w.window.detach()
+}
@@ -0,0 +1,37 @@
+package httpserver
+
+import (
+	"chrome_render/clip"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// createClip serves POST /clips with a clip.Request body and answers with
+// the catalog entry of the clip, downloadable at /recordings/{id}/download.
+func createClip(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req clip.Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+
+	rec, err := clip.Extract(&req)
+	switch {
+	case errors.Is(err, clip.ErrInvalidRange), errors.Is(err, clip.ErrFormat):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, clip.ErrNoRecording):
+		writeError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		logrus.WithError(err).Errorf("extract clip of task %s failed", req.TaskName)
+		writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		writeJSON(w, http.StatusCreated, rec)
+	}
+}
@@ -0,0 +1,45 @@
+package httpserver
+
+import (
+	"chrome_render/hls"
+	"net/http"
+	"strings"
+)
+
+// hlsHandler serves the time-shift window of a task:
+// GET /hls/{task}/live.m3u8, /hls/{task}/event.m3u8 and the segments.
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/hls/"), "/")
+	if len(parts) != 2 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	taskName, name := parts[0], parts[1]
+
+	switch {
+	case name == "live.m3u8" || name == "event.m3u8":
+		playlist, ok := hls.Playlist(taskName, name == "live.m3u8")
+		if !ok {
+			writeError(w, http.StatusNotFound, "no hls output of task")
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(playlist))
+	case strings.HasSuffix(name, ".ts"):
+		path, ok := hls.SegmentPath(taskName, name)
+		if !ok {
+			writeError(w, http.StatusNotFound, "segment not found")
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		http.ServeFile(w, r, path)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
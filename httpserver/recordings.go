@@ -0,0 +1,105 @@
+package httpserver
+
+import (
+	"chrome_render/catalog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// listRecordings serves GET /recordings?task=&from=&to=, times in RFC 3339.
+func listRecordings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	filter := catalog.Filter{TaskName: r.URL.Query().Get("task")}
+	for name, t := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if v := r.URL.Query().Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid "+name+": "+err.Error())
+				return
+			}
+			*t = parsed
+		}
+	}
+
+	writeJSON(w, http.StatusOK, catalog.List(filter))
+}
+
+// recordingHandler serves GET /recordings/{id}, /recordings/{id}/download
+// and the thumbnails track /recordings/{id}/thumbnails.vtt with its sprites.
+func recordingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/recordings/"), "/")
+	rec, ok := catalog.Get(parts[0])
+	if !ok {
+		writeError(w, http.StatusNotFound, "recording not found")
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		writeJSON(w, http.StatusOK, rec)
+	case len(parts) == 2 && parts[1] == "download":
+		download(w, r, rec)
+	case len(parts) == 2 && rec.Thumbnails != "" && parts[1] == filepath.Base(rec.Thumbnails):
+		w.Header().Set("Content-Type", "text/vtt")
+		http.ServeFile(w, r, rec.Thumbnails)
+	case len(parts) == 2 && isSprite(rec, parts[1]):
+		http.ServeFile(w, r, filepath.Join(filepath.Dir(rec.Thumbnails), parts[1]))
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// download serves the local file with Range support so players can seek,
+// or redirects to the storage location once the local copy is gone.
+func download(w http.ResponseWriter, r *http.Request, rec *catalog.Recording) {
+	fd, err := os.Open(rec.Path)
+	if err != nil {
+		if strings.HasPrefix(rec.Location, "http://") || strings.HasPrefix(rec.Location, "https://") {
+			http.Redirect(w, r, rec.Location, http.StatusFound)
+			return
+		}
+		writeError(w, http.StatusNotFound, "recording file not available")
+		return
+	}
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", videoType(rec.Path))
+	w.Header().Set("Content-Disposition", "inline; filename=\""+filepath.Base(rec.Path)+"\"")
+	http.ServeContent(w, r, filepath.Base(rec.Path), info.ModTime(), fd)
+}
+
+// videoType is the content type of a recording or clip by its extension,
+// clips may be transcoded to mp4.
+func videoType(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".mp4") {
+		return "video/mp4"
+	}
+	return "video/webm"
+}
+
+func isSprite(rec *catalog.Recording, name string) bool {
+	for _, sprite := range rec.Sprites {
+		if filepath.Base(sprite) == name {
+			return true
+		}
+	}
+	return false
+}
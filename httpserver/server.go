@@ -0,0 +1,43 @@
+package httpserver
+
+import (
+	"chrome_render/config"
+	"chrome_render/quota"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+var conf = config.GetConfig()
+
+// Start runs the control http server on the configured address.
+func Start() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/recordings", listRecordings)
+	mux.HandleFunc("/recordings/", recordingHandler)
+	mux.HandleFunc("/clips", createClip)
+	mux.HandleFunc("/hls/", hlsHandler)
+	mux.HandleFunc("/disk", diskStatus)
+	mux.HandleFunc("/tasks", listTasks)
+	mux.HandleFunc("/tasks/", taskHandler)
+
+	logrus.Printf("control http server listen on %s", *conf.HttpAddr)
+	logrus.Fatal(http.ListenAndServe(*conf.HttpAddr, mux))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.WithError(err).Warnln("write json response failed")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// diskStatus serves GET /disk, the last check of the disk guard.
+func diskStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, quota.GetStatus())
+}
@@ -0,0 +1,33 @@
+package httpserver
+
+import (
+	"chrome_render/chrome"
+	"net/http"
+	"strings"
+)
+
+// listTasks serves GET /tasks, the running and recently done tasks.
+func listTasks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, chrome.TaskStatuses())
+}
+
+// taskHandler serves GET /tasks/{name}, the status of the task with the
+// report of its recorded segments.
+func taskHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	status := chrome.TaskStatus(strings.TrimPrefix(r.URL.Path, "/tasks/"))
+	if status == nil {
+		writeError(w, http.StatusNotFound, "task not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
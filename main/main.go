@@ -1,19 +1,35 @@
 package main
 
 import (
+	"chrome_render/cgroup"
 	"chrome_render/chrome"
 	"chrome_render/config"
+	"chrome_render/httpserver"
+	"chrome_render/quota"
+	"chrome_render/reaper"
 	"chrome_render/wsserver"
 	"context"
 	"fmt"
+	"github.com/sirupsen/logrus"
 )
 
 var actionFunCtx  context.Context
 
 func main()  {
 	ch  := make(chan error, 1)
+	config.Load()
+	if err := chrome.CheckOptions(); err != nil {
+		logrus.WithError(err).Fatalln("invalid chrome options")
+	}
+	reaper.Reap()
+	cgroup.Cleanup()
+	wsserver.Recover()
+	wsserver.ResumeUploads()
+	go chrome.StartPool(context.Background())
 	go neChrome()
 	go wsserver.Start()
+	go httpserver.Start()
+	go quota.Start()
 	<-ch
 }
 
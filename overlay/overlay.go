@@ -0,0 +1,128 @@
+package overlay
+
+import (
+	"bytes"
+	"chrome_render/config"
+	"github.com/sirupsen/logrus"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	margin      = 8
+	padding     = 4
+	timeLayout  = "2006-01-02 15:04:05"
+	defaultSpot = "bottom-right"
+)
+
+var conf = config.GetConfig()
+
+var (
+	watermarkOnce sync.Once
+	watermark     image.Image
+)
+
+// Enabled reports whether frames get an overlay.
+func Enabled() bool {
+	return *conf.Overlay || *conf.Watermark != ""
+}
+
+// Apply draws the wall-clock time and the task name, and the watermark,
+// onto a jpeg frame and encodes it again. Unlike a clock in the page it
+// survives navigation and cannot be hidden by the page.
+func Apply(taskName string, jpg []byte, t time.Time) ([]byte, error) {
+	src, err := jpeg.Decode(bytes.NewReader(jpg))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	img := image.NewRGBA(bounds)
+	draw.Draw(img, bounds, src, bounds.Min, draw.Src)
+
+	if wm := loadWatermark(); wm != nil {
+		size := wm.Bounds().Size()
+		at := corner(bounds, size, *conf.WatermarkPosition)
+		mask := image.NewUniform(alpha(*conf.WatermarkOpacity))
+		draw.DrawMask(img, image.Rectangle{Min: at, Max: at.Add(size)}, wm, wm.Bounds().Min, mask, image.Point{}, draw.Over)
+	}
+
+	if *conf.Overlay {
+		scale := *conf.OverlayScale
+		if scale < 1 {
+			scale = 1
+		}
+		lines := []string{t.Format(timeLayout), taskName}
+		size := textSize(lines, scale).Add(image.Pt(2*padding, 2*padding))
+		at := corner(bounds, size, *conf.OverlayPosition)
+		opacity := alpha(*conf.OverlayOpacity).A
+
+		box := image.NewUniform(color.NRGBA{A: opacity / 2})
+		draw.Draw(img, image.Rectangle{Min: at, Max: at.Add(size)}, box, image.Point{}, draw.Over)
+		drawText(img, at.Add(image.Pt(padding, padding)), lines, scale, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: opacity})
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: *conf.JpegQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func loadWatermark() image.Image {
+	watermarkOnce.Do(func() {
+		if *conf.Watermark == "" {
+			return
+		}
+
+		fd, err := os.Open(*conf.Watermark)
+		if err != nil {
+			logrus.WithError(err).Errorln("open watermark failed")
+			return
+		}
+		defer fd.Close()
+
+		img, err := png.Decode(fd)
+		if err != nil {
+			logrus.WithError(err).Errorln("decode watermark failed")
+			return
+		}
+		watermark = img
+	})
+	return watermark
+}
+
+// corner returns where a box of size goes in bounds for a position like
+// "top-left", keeping a margin to the edges.
+func corner(bounds image.Rectangle, size image.Point, position string) image.Point {
+	switch position {
+	case "top-left", "top-right", "bottom-left", "bottom-right":
+	default:
+		position = defaultSpot
+	}
+
+	at := image.Pt(bounds.Min.X+margin, bounds.Min.Y+margin)
+	if position == "top-right" || position == "bottom-right" {
+		at.X = bounds.Max.X - margin - size.X
+	}
+	if position == "bottom-left" || position == "bottom-right" {
+		at.Y = bounds.Max.Y - margin - size.Y
+	}
+	return at
+}
+
+func alpha(percent int) color.Alpha {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	return color.Alpha{A: uint8(percent * 0xff / 100)}
+}
@@ -0,0 +1,66 @@
+package pulse
+
+import (
+	"chrome_render/config"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+const sinkPrefix = "chrome_render_"
+
+var conf = config.GetConfig()
+
+var (
+	sinkSeq     int64
+	invalidName = regexp.MustCompile(`[^A-Za-z0-9_]`)
+)
+
+// Sink is a pulseaudio null sink owned by one task. Chrome plays into it and
+// the encoder records its monitor source.
+type Sink struct {
+	Name   string
+	module string
+}
+
+// Enabled reports whether tasks get their own sink.
+func Enabled() bool {
+	return *conf.PactlPath != ""
+}
+
+// Load creates a null sink for the task.
+func Load(taskName string) (*Sink, error) {
+	name := fmt.Sprintf("%s%s_%d", sinkPrefix, invalidName.ReplaceAllString(taskName, "_"), atomic.AddInt64(&sinkSeq, 1))
+	out, err := exec.Command(*conf.PactlPath, "load-module", "module-null-sink",
+		"sink_name="+name,
+		"sink_properties=device.description="+name).Output()
+	if err != nil {
+		return nil, fmt.Errorf("load null sink %s: %w", name, err)
+	}
+
+	s := &Sink{Name: name, module: strings.TrimSpace(string(out))}
+	logrus.Printf("pulseaudio sink %s loaded, module %s. task name: %s", s.Name, s.module, taskName)
+	return s, nil
+}
+
+// Env is the environment variable making chrome play into the sink.
+func (s *Sink) Env() string {
+	return "PULSE_SINK=" + s.Name
+}
+
+// Monitor is the source recording what is played into the sink.
+func (s *Sink) Monitor() string {
+	return s.Name + ".monitor"
+}
+
+// Unload removes the sink.
+func (s *Sink) Unload() {
+	if err := exec.Command(*conf.PactlPath, "unload-module", s.module).Run(); err != nil {
+		logrus.WithError(err).Errorf("unload pulseaudio sink %s failed", s.Name)
+		return
+	}
+	logrus.Printf("pulseaudio sink %s unloaded", s.Name)
+}
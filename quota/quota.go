@@ -0,0 +1,338 @@
+package quota
+
+import (
+	"chrome_render/config"
+	"chrome_render/wsserver"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Levels of the guard, each breach check that fails moves one level up, so
+// frame dumping is stopped first, then recordings are paused, then stopped.
+const (
+	LevelOk = iota
+	LevelNoFrames
+	LevelPaused
+	LevelStopped
+)
+
+var levelNames = []string{"ok", "no-frames", "paused", "stopped"}
+
+var conf = config.GetConfig()
+
+// Status is the result of the last check.
+type Status struct {
+	UsedBytes  int64             `json:"usedBytes"`
+	FreeBytes  int64             `json:"freeBytes"`
+	TaskBytes  map[string]int64  `json:"taskBytes"`
+	Level      string            `json:"level"`
+	TaskLevels map[string]string `json:"taskLevels"`
+	CheckTime  time.Time         `json:"checkTime"`
+}
+
+var (
+	lock        sync.Mutex
+	globalLevel int
+	taskLevels  = map[string]int{}
+	applied     = map[string]int{}
+	status      Status
+)
+
+// Start checks the disk usage periodically.
+func Start() {
+	interval := time.Duration(*conf.DiskCheckInterval) * time.Second
+	if interval <= 0 {
+		logrus.Warnln("disk guard disabled")
+		return
+	}
+	logrus.Printf("disk guard started. disk quota: %d MB, task disk quota: %d MB, min free space: %d MB",
+		*conf.DiskQuota, *conf.TaskDiskQuota, *conf.MinFreeSpace)
+
+	for {
+		check()
+		time.Sleep(interval)
+	}
+}
+
+// FramesAllowed reports whether the task may still dump jpeg frames.
+func FramesAllowed(taskName string) bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return effectiveLevel(taskName) < LevelNoFrames
+}
+
+// GetStatus returns the result of the last check.
+func GetStatus() Status {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return status
+}
+
+func effectiveLevel(taskName string) int {
+	if level := taskLevels[taskName]; level > globalLevel {
+		return level
+	}
+	return globalLevel
+}
+
+func check() {
+	taskBytes := map[string]int64{}
+	used := recordingUsage(taskBytes) +
+		dirUsage(*conf.FrameJpgPath, taskBytes, taskDir) +
+		dirUsage(*conf.HlsPath, taskBytes, taskDir) +
+		dirUsage(*conf.ThumbnailPath, taskBytes, recordingTask)
+	free := freeSpace()
+
+	globalQuota := int64(*conf.DiskQuota) << 20
+	taskQuota := int64(*conf.TaskDiskQuota) << 20
+	minFree := int64(*conf.MinFreeSpace) << 20
+
+	// the commands wait for the extension to ack, they are sent once the
+	// levels are updated so FramesAllowed doesn't wait on them
+	var commands []func()
+	defer func() {
+		for _, command := range commands {
+			command()
+		}
+	}()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	var reasons []string
+	if globalQuota > 0 && used > globalQuota {
+		reasons = append(reasons, fmt.Sprintf("disk quota exceeded: %d/%d MB", used>>20, globalQuota>>20))
+	}
+	if minFree > 0 && free >= 0 && free < minFree {
+		reasons = append(reasons, fmt.Sprintf("free space low: %d MB < %d MB", free>>20, minFree>>20))
+	}
+	globalLevel = step("", globalLevel, strings.Join(reasons, ", "))
+
+	tasks := map[string]bool{}
+	for _, taskName := range wsserver.ActiveTasks() {
+		tasks[taskName] = true
+	}
+	for taskName := range taskBytes {
+		tasks[taskName] = true
+	}
+	for taskName := range taskLevels {
+		tasks[taskName] = true
+	}
+
+	for taskName := range tasks {
+		reason := ""
+		if taskQuota > 0 && taskBytes[taskName] > taskQuota {
+			reason = fmt.Sprintf("task disk quota exceeded: %d/%d MB", taskBytes[taskName]>>20, taskQuota>>20)
+		}
+		if level := step(taskName, taskLevels[taskName], reason); level > LevelOk {
+			taskLevels[taskName] = level
+		} else {
+			delete(taskLevels, taskName)
+		}
+	}
+
+	for taskName := range tasks {
+		if command := apply(taskName, effectiveLevel(taskName)); command != nil {
+			commands = append(commands, command)
+		}
+	}
+
+	status = Status{
+		UsedBytes:  used,
+		FreeBytes:  free,
+		TaskBytes:  taskBytes,
+		Level:      levelNames[globalLevel],
+		TaskLevels: map[string]string{},
+		CheckTime:  time.Now(),
+	}
+	for taskName, level := range taskLevels {
+		status.TaskLevels[taskName] = levelNames[level]
+	}
+}
+
+// step moves a level up while the reason persists and back to ok once it's
+// gone, alerting on every change.
+func step(taskName string, level int, reason string) int {
+	if reason == "" {
+		if level > LevelOk {
+			alert(taskName, wsserver.EventQuotaRecovered, "disk usage back to normal")
+		}
+		return LevelOk
+	}
+
+	if level < LevelStopped {
+		level++
+		alert(taskName, wsserver.EventQuotaExceeded, fmt.Sprintf("%s, guard level %s", reason, levelNames[level]))
+	}
+	return level
+}
+
+// apply records the level of the task and returns the command pausing,
+// stopping, resuming or restarting its recording to match it, nil when
+// there is nothing to send. The caller holds the lock.
+func apply(taskName string, level int) func() {
+	prev := applied[taskName]
+	if level == prev {
+		return nil
+	}
+	if level == LevelOk {
+		delete(applied, taskName)
+	} else {
+		applied[taskName] = level
+	}
+
+	var send func() error
+	switch {
+	case level == LevelStopped:
+		send = func() error {
+			return wsserver.SendCommand(taskName, wsserver.ActionStop, wsserver.CaptureOptions{})
+		}
+	case level == LevelPaused && prev < LevelPaused:
+		send = func() error {
+			return wsserver.SendCommand(taskName, wsserver.ActionPause, wsserver.CaptureOptions{})
+		}
+	case level < LevelPaused && prev == LevelPaused:
+		send = func() error {
+			return wsserver.SendCommand(taskName, wsserver.ActionResume, wsserver.CaptureOptions{})
+		}
+	case level < LevelPaused && prev == LevelStopped:
+		send = func() error {
+			return wsserver.StartCapture(taskName)
+		}
+	default:
+		return nil
+	}
+
+	return func() {
+		err := send()
+		if err == nil {
+			return
+		}
+		if err == wsserver.ErrNotConnected {
+			logrus.Warnf("apply disk guard level %s failed, recorder not connected. task name: %s", levelNames[level], taskName)
+		} else {
+			logrus.WithError(err).Errorf("apply disk guard level %s failed. task name: %s", levelNames[level], taskName)
+		}
+
+		// retried by the next check
+		lock.Lock()
+		defer lock.Unlock()
+		if applied[taskName] == level {
+			if prev == LevelOk {
+				delete(applied, taskName)
+			} else {
+				applied[taskName] = prev
+			}
+		}
+	}
+}
+
+// alert reports a guard change as a task event, globally to every active task.
+func alert(taskName, eventType, reason string) {
+	if taskName == "" {
+		logrus.Warnf("disk guard: %s", reason)
+		for _, name := range wsserver.ActiveTasks() {
+			wsserver.Emit(&wsserver.Event{TaskName: name, Type: eventType, Reason: reason})
+		}
+		return
+	}
+
+	logrus.Warnf("disk guard: %s. task name: %s", reason, taskName)
+	wsserver.Emit(&wsserver.Event{TaskName: taskName, Type: eventType, Reason: reason})
+}
+
+// recordingUsage sums the recordings, named <task>_<unix nano>-<session>.webm.
+func recordingUsage(taskBytes map[string]int64) int64 {
+	files, err := ioutil.ReadDir(*conf.LocalVideoPath)
+	if err != nil {
+		return 0
+	}
+
+	var total int64
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		total += file.Size()
+
+		name := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+		if taskName := recordingTask(name); taskName != "" {
+			taskBytes[taskName] += file.Size()
+		}
+	}
+	return total
+}
+
+// dirUsage sums the output kept in a directory per task or per recording,
+// the jpeg frames, hls segments and thumbnail sprites.
+func dirUsage(root string, taskBytes map[string]int64, taskOf func(string) string) int64 {
+	if root == "" {
+		return 0
+	}
+
+	dirs, err := ioutil.ReadDir(root)
+	if err != nil {
+		return 0
+	}
+
+	var total int64
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		size := dirSize(filepath.Join(root, dir.Name()))
+		if taskName := taskOf(dir.Name()); taskName != "" {
+			taskBytes[taskName] += size
+		}
+		total += size
+	}
+	return total
+}
+
+func taskDir(name string) string {
+	return name
+}
+
+// recordingTask returns the task of a recording id, "" when it has none.
+func recordingTask(id string) string {
+	if i := strings.LastIndex(id, "_"); i > 0 {
+		return id[:i]
+	}
+	return ""
+}
+
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// freeSpace returns the bytes available on the recordings filesystem, -1
+// when it can't be read.
+func freeSpace() int64 {
+	path := *conf.LocalVideoPath
+	if _, err := os.Stat(path); err != nil {
+		path = filepath.Dir(path)
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		logrus.WithError(err).Warnf("statfs %s failed", path)
+		return -1
+	}
+	return int64(st.Bavail) * int64(st.Bsize)
+}
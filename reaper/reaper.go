@@ -0,0 +1,253 @@
+package reaper
+
+import (
+	"chrome_render/config"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const killTimeout = 5 * time.Second
+
+var conf = config.GetConfig()
+
+// Process is a child process recorded in the pid directory, so a restarted
+// service can terminate what a crashed one left running.
+type Process struct {
+	Kind      string `json:"kind"`
+	Owner     string `json:"owner"`
+	Pid       int    `json:"pid"`
+	Pgid      int    `json:"pgid"`
+	StartTime uint64 `json:"startTime"` // clock ticks after boot, tells a reused pid apart
+	BootId    string `json:"bootId"`
+}
+
+// Track records a started process of the kind, e.g. chrome or xvfb, for the
+// owner, a task or a display.
+func Track(kind, owner string, pid int) (*Process, error) {
+	st, err := readStat(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Process{Kind: kind, Owner: owner, Pid: pid, Pgid: st.pgid, StartTime: st.startTime, BootId: bootId()}
+	if *conf.PidDir == "" {
+		return p, nil
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return p, err
+	}
+	if err := os.MkdirAll(*conf.PidDir, 0755); err != nil {
+		return p, err
+	}
+	return p, ioutil.WriteFile(pidPath(kind, pid), data, 0644)
+}
+
+// Untrack forgets a process that exited or was killed.
+func Untrack(kind string, pid int) {
+	if *conf.PidDir == "" {
+		return
+	}
+	if err := os.Remove(pidPath(kind, pid)); err != nil && !os.IsNotExist(err) {
+		logrus.WithError(err).Warnf("remove pid file of %s %d failed", kind, pid)
+	}
+}
+
+// Reap terminates the processes recorded by a previous run which are still
+// alive, and removes their pid files.
+func Reap() {
+	if *conf.PidDir == "" {
+		return
+	}
+
+	files, err := filepath.Glob(filepath.Join(*conf.PidDir, "*.pid"))
+	if err != nil {
+		return
+	}
+
+	boot := bootId()
+	for _, file := range files {
+		var p Process
+		data, err := ioutil.ReadFile(file)
+		if err == nil {
+			err = json.Unmarshal(data, &p)
+		}
+		if err != nil {
+			logrus.WithError(err).Warnf("read pid file %s failed", file)
+			os.Remove(file)
+			continue
+		}
+
+		st, err := readStat(p.Pid)
+		if err == nil && p.BootId == boot && st.startTime == p.StartTime && st.state != 'Z' {
+			logrus.Warnf("orphaned %s %d of %s left by a previous run, killing it", p.Kind, p.Pid, p.Owner)
+			KillTree(p.Pid)
+		}
+		os.Remove(file)
+	}
+}
+
+// KillTree terminates the process and all its descendants, killing those
+// still alive after a timeout.
+func KillTree(pid int) {
+	pids := append(Descendants(pid), pid)
+	for _, p := range pids {
+		syscall.Kill(p, syscall.SIGTERM)
+	}
+
+	deadline := time.Now().Add(killTimeout)
+	for time.Now().Before(deadline) {
+		if !anyAlive(pids) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for _, p := range pids {
+		if alive(p) {
+			syscall.Kill(p, syscall.SIGKILL)
+		}
+	}
+}
+
+// ProcessGroup returns the process group of pid, 0 when it's gone.
+func ProcessGroup(pid int) int {
+	st, err := readStat(pid)
+	if err != nil {
+		return 0
+	}
+	return st.pgid
+}
+
+// FindByArgs returns the processes whose command line has all the args.
+func FindByArgs(args ...string) []int {
+	var pids []int
+	for _, pid := range listPids() {
+		data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+		if err != nil {
+			continue
+		}
+		cmdline := map[string]bool{}
+		for _, arg := range strings.Split(string(data), "\x00") {
+			cmdline[arg] = true
+		}
+
+		found := true
+		for _, arg := range args {
+			if !cmdline[arg] {
+				found = false
+				break
+			}
+		}
+		if found {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// Args returns the command line of the process.
+func Args(pid int) []string {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+}
+
+func pidPath(kind string, pid int) string {
+	return filepath.Join(*conf.PidDir, fmt.Sprintf("%s_%d.pid", kind, pid))
+}
+
+type stat struct {
+	state     byte
+	ppid      int
+	pgid      int
+	startTime uint64
+}
+
+// readStat parses /proc/<pid>/stat, the fields after the command name
+// which may itself contain spaces and parentheses.
+func readStat(pid int) (*stat, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	s := string(data)
+	n := strings.LastIndex(s, ")")
+	if n < 0 {
+		return nil, fmt.Errorf("invalid stat of process %d", pid)
+	}
+	fields := strings.Fields(s[n+1:])
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("invalid stat of process %d", pid)
+	}
+
+	st := &stat{state: fields[0][0]}
+	st.ppid, _ = strconv.Atoi(fields[1])
+	st.pgid, _ = strconv.Atoi(fields[2])
+	st.startTime, _ = strconv.ParseUint(fields[19], 10, 64)
+	return st, nil
+}
+
+func listPids() []int {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	for _, dir := range dirs {
+		if pid, err := strconv.Atoi(dir.Name()); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// Descendants returns the children of the process, theirs and so on.
+func Descendants(pid int) []int {
+	children := map[int][]int{}
+	for _, p := range listPids() {
+		if st, err := readStat(p); err == nil {
+			children[st.ppid] = append(children[st.ppid], p)
+		}
+	}
+
+	var list []int
+	queue := children[pid]
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		list = append(list, p)
+		queue = append(queue, children[p]...)
+	}
+	return list
+}
+
+func alive(pid int) bool {
+	st, err := readStat(pid)
+	return err == nil && st.state != 'Z'
+}
+
+func anyAlive(pids []int) bool {
+	for _, pid := range pids {
+		if alive(pid) {
+			return true
+		}
+	}
+	return false
+}
+
+func bootId() string {
+	data, _ := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+	return strings.TrimSpace(string(data))
+}
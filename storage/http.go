@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tusVersion       = "1.0.0"
+	defaultChunkSize = 4 << 20
+	uploadStateExt   = ".upload"
+)
+
+// HTTPBackend uploads to the record domain with the tus resumable upload
+// protocol. The upload url is kept next to the local file, so a retry or a
+// restart continues from the offset the server already has instead of
+// sending the whole file again.
+type HTTPBackend struct {
+	endpoint  string
+	chunkSize int64
+	client    *http.Client
+}
+
+func NewHTTPBackend(endpoint string, chunkSize int64) (*HTTPBackend, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid record domain: %s", endpoint)
+	}
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+
+	return &HTTPBackend{
+		endpoint:  strings.TrimSuffix(endpoint, "/") + "/uploads",
+		chunkSize: chunkSize,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (b *HTTPBackend) Name() string {
+	return fmt.Sprintf("record domain (%s)", b.endpoint)
+}
+
+func (b *HTTPBackend) IsLocal() bool {
+	return false
+}
+
+// PendingUploads lists the files in dir with an upload to the record domain
+// left unfinished, a previous run died or gave up before it completed.
+func PendingUploads(dir string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+uploadStateExt))
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, match := range matches {
+		path := strings.TrimSuffix(match, uploadStateExt)
+		if _, err := os.Stat(path); err != nil {
+			// the file went away, the upload can't continue
+			os.Remove(match)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func (b *HTTPBackend) Upload(ctx context.Context, key, localPath string, metadata map[string]string) (string, error) {
+	fd, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	checksum, err := fileSHA256(fd)
+	if err != nil {
+		return "", err
+	}
+
+	statePath := localPath + uploadStateExt
+	uploadURL, offset := b.resume(ctx, statePath, info.Size())
+	if uploadURL == "" {
+		if uploadURL, err = b.create(ctx, key, info.Size(), checksum, metadata); err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(statePath, []byte(uploadURL), 0644); err != nil {
+			return "", err
+		}
+		offset = 0
+	}
+
+	location := uploadURL
+	buf := make([]byte, b.chunkSize)
+	for offset < info.Size() || info.Size() == 0 {
+		n, err := fd.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+
+		var remote string
+		if offset, remote, err = b.patch(ctx, uploadURL, offset, buf[:n]); err != nil {
+			return "", err
+		}
+		if remote != "" {
+			location = remote
+		}
+		if info.Size() == 0 {
+			break
+		}
+	}
+
+	os.Remove(statePath)
+	return location, nil
+}
+
+// Delete is not part of the upload protocol, the record domain owns the file.
+func (b *HTTPBackend) Delete(ctx context.Context, key string) error {
+	return errors.New("record domain does not support delete")
+}
+
+// resume returns the saved upload url and the offset the server has, or an
+// empty url when the upload has to start over.
+func (b *HTTPBackend) resume(ctx context.Context, statePath string, size int64) (string, int64) {
+	data, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return "", 0
+	}
+	uploadURL := strings.TrimSpace(string(data))
+
+	req, err := http.NewRequest(http.MethodHead, uploadURL, nil)
+	if err != nil {
+		return "", 0
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+
+	resp, err := b.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", 0
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", 0
+	}
+
+	offset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 || offset > size {
+		return "", 0
+	}
+	return uploadURL, offset
+}
+
+// create announces the upload with its size, checksum and task metadata.
+func (b *HTTPBackend) create(ctx context.Context, key string, size int64, checksum string, metadata map[string]string) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, b.endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+	req.Header.Set("X-Content-Sha256", checksum)
+	req.Header.Set("X-Object-Key", key)
+
+	meta := map[string]string{"filename": filepath.Base(key), "key": key, "sha256": checksum}
+	for k, v := range metadata {
+		meta[k] = v
+		req.Header.Set("X-"+k, v)
+	}
+	req.Header.Set("Upload-Metadata", encodeMetadata(meta))
+
+	resp, err := b.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("create upload failed: %s %s", resp.Status, body)
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return "", fmt.Errorf("create upload returned no location: %v", err)
+	}
+	return location.String(), nil
+}
+
+// patch sends one chunk and returns the new offset, and the remote url of
+// the file when the server reports it on the last chunk.
+func (b *HTTPBackend) patch(ctx context.Context, uploadURL string, offset int64, chunk []byte) (int64, string, error) {
+	req, err := http.NewRequest(http.MethodPatch, uploadURL, bytes.NewReader(chunk))
+	if err != nil {
+		return offset, "", err
+	}
+
+	sum := sha1.Sum(chunk)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	req.Header.Set("Upload-Checksum", "sha1 "+base64.StdEncoding.EncodeToString(sum[:]))
+
+	resp, err := b.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return offset, "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return offset, "", fmt.Errorf("upload chunk at %d failed: %s %s", offset, resp.Status, body)
+	}
+
+	newOffset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || newOffset <= offset && len(chunk) > 0 {
+		return offset, "", fmt.Errorf("upload chunk at %d returned invalid offset: %q", offset, resp.Header.Get("Upload-Offset"))
+	}
+
+	remote := resp.Header.Get("X-Record-Url")
+	var result struct {
+		Url string `json:"url"`
+	}
+	if json.Unmarshal(body, &result) == nil && result.Url != "" {
+		remote = result.Url
+	}
+	return newOffset, remote, nil
+}
+
+func fileSHA256(r io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// encodeMetadata formats the tus Upload-Metadata header.
+func encodeMetadata(meta map[string]string) string {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(meta[k])))
+	}
+	return strings.Join(pairs, ",")
+}
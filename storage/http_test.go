@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeTus is a record domain accepting tus uploads, failing the chunk at
+// failAt once.
+type fakeTus struct {
+	lock    sync.Mutex
+	data    []byte
+	length  int64
+	creates int
+	failAt  int64
+	failed  bool
+	gone    bool
+}
+
+func (s *fakeTus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		http.Error(w, "not a tus request", http.StatusPreconditionFailed)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/uploads":
+		s.creates++
+		s.data = nil
+		s.gone = false
+		s.length, _ = strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		w.Header().Set("Location", "/uploads/1")
+		w.WriteHeader(http.StatusCreated)
+
+	case r.URL.Path != "/uploads/1" || s.gone:
+		http.NotFound(w, r)
+
+	case r.Method == http.MethodHead:
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(s.data)))
+
+	case r.Method == http.MethodPatch:
+		offset, _ := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if offset != int64(len(s.data)) {
+			http.Error(w, "offset mismatch", http.StatusConflict)
+			return
+		}
+		if offset == s.failAt && !s.failed {
+			s.failed = true
+			http.Error(w, "gateway timeout", http.StatusGatewayTimeout)
+			return
+		}
+		chunk, _ := ioutil.ReadAll(r.Body)
+		s.data = append(s.data, chunk...)
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(s.data)))
+		if int64(len(s.data)) == s.length {
+			w.Header().Set("X-Record-Url", "http://records/a.webm")
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func newTestHTTP(t *testing.T, s *fakeTus) *HTTPBackend {
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	b, err := NewHTTPBackend(server.URL, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func readState(path string) string {
+	data, _ := ioutil.ReadFile(path + uploadStateExt)
+	return string(data)
+}
+
+func TestHTTPUploadResume(t *testing.T) {
+	s := &fakeTus{failAt: 4}
+	b := newTestHTTP(t, s)
+	path, data := writeTestFile(t, 10)
+
+	if _, err := b.Upload(context.Background(), "recordings/a.webm", path, nil); err == nil {
+		t.Fatal("upload succeeded with a failing chunk")
+	}
+	if state := readState(path); state == "" {
+		t.Fatal("no upload state kept after the failed chunk")
+	}
+
+	location, err := b.Upload(context.Background(), "recordings/a.webm", path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location != "http://records/a.webm" {
+		t.Errorf("location %s", location)
+	}
+	if s.creates != 1 {
+		t.Errorf("upload created %d times, want it resumed", s.creates)
+	}
+	if !bytes.Equal(s.data, data) {
+		t.Errorf("uploaded %q, want %q", s.data, data)
+	}
+	if _, err := os.Stat(path + uploadStateExt); !os.IsNotExist(err) {
+		t.Errorf("upload state left after the upload: %v", err)
+	}
+}
+
+func TestHTTPUploadStaleState(t *testing.T) {
+	s := &fakeTus{failAt: 4}
+	b := newTestHTTP(t, s)
+	path, data := writeTestFile(t, 10)
+
+	b.Upload(context.Background(), "recordings/a.webm", path, nil)
+	// the server dropped the partial upload meanwhile
+	s.gone = true
+
+	if _, err := b.Upload(context.Background(), "recordings/a.webm", path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.creates != 2 {
+		t.Errorf("upload created %d times, want it started over", s.creates)
+	}
+	if !bytes.Equal(s.data, data) {
+		t.Errorf("uploaded %q, want %q", s.data, data)
+	}
+}
+
+func TestEncodeMetadata(t *testing.T) {
+	got := encodeMetadata(map[string]string{"key": "recordings/a.webm", "Task-Name": "a"})
+	if want := "Task-Name YQ==,key cmVjb3JkaW5ncy9hLndlYm0="; got != want {
+		t.Errorf("metadata %s, want %s", got, want)
+	}
+}
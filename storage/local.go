@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"context"
+	"os"
+)
+
+// LocalBackend keeps the files where the writers put them.
+type LocalBackend struct{}
+
+func (b *LocalBackend) Name() string {
+	return "local"
+}
+
+func (b *LocalBackend) Upload(ctx context.Context, key, localPath string, metadata map[string]string) (string, error) {
+	if _, err := os.Stat(localPath); err != nil {
+		return "", err
+	}
+	return localPath, nil
+}
+
+// Delete removes the file, key being its local path for this backend.
+func (b *LocalBackend) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(key); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (b *LocalBackend) IsLocal() bool {
+	return true
+}
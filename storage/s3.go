@@ -0,0 +1,361 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPartSize = 8 << 20
+	minPartSize     = 5 << 20
+)
+
+// S3Options configures an S3-compatible object store.
+type S3Options struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string
+	PathStyle bool
+	PartSize  int64
+}
+
+// S3Backend uploads to an S3-compatible object store, signing requests with
+// AWS signature V4. Files larger than one part use multipart upload.
+type S3Backend struct {
+	opts     S3Options
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewS3Backend(opts S3Options) (*S3Backend, error) {
+	if opts.Endpoint == "" || opts.Bucket == "" {
+		return nil, errors.New("s3 endpoint and bucket are required")
+	}
+
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", opts.Endpoint)
+	}
+
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	if opts.PartSize <= 0 {
+		opts.PartSize = defaultPartSize
+	}
+	if opts.PartSize < minPartSize {
+		opts.PartSize = minPartSize
+	}
+
+	return &S3Backend{
+		opts:     opts,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Minute},
+	}, nil
+}
+
+func (b *S3Backend) Name() string {
+	return fmt.Sprintf("s3 (%s/%s)", b.opts.Endpoint, b.opts.Bucket)
+}
+
+func (b *S3Backend) IsLocal() bool {
+	return false
+}
+
+// objectURL returns the url of the object, path or virtual-host style.
+func (b *S3Backend) objectURL(key string, query url.Values) *url.URL {
+	u := *b.endpoint
+	key = strings.TrimPrefix(b.opts.Prefix+key, "/")
+
+	if b.opts.PathStyle {
+		u.Path = "/" + b.opts.Bucket + "/" + key
+	} else {
+		u.Host = b.opts.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = encodePath(u.Path)
+	u.RawQuery = encodeQuery(query)
+	return &u
+}
+
+func (b *S3Backend) Upload(ctx context.Context, key, localPath string, metadata map[string]string) (string, error) {
+	fd, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	if info.Size() <= b.opts.PartSize {
+		data, err := ioutil.ReadAll(fd)
+		if err != nil {
+			return "", err
+		}
+		if _, err := b.do(ctx, http.MethodPut, key, nil, data, metadata); err != nil {
+			return "", err
+		}
+	} else if err := b.uploadMultipart(ctx, key, fd, info.Size(), metadata); err != nil {
+		return "", err
+	}
+
+	return b.objectURL(key, nil).String(), nil
+}
+
+func (b *S3Backend) Delete(ctx context.Context, key string) error {
+	_, err := b.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	return err
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+func (b *S3Backend) uploadMultipart(ctx context.Context, key string, r io.ReaderAt, size int64, metadata map[string]string) error {
+	resp, err := b.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, metadata)
+	if err != nil {
+		return err
+	}
+
+	var initiated struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp, &initiated); err != nil {
+		return err
+	}
+	if initiated.UploadId == "" {
+		return errors.New("s3 returned no upload id")
+	}
+
+	uploadId := initiated.UploadId
+	abort := func() {
+		// parts of a failed abort are left for the bucket lifecycle rules
+		b.do(context.Background(), http.MethodDelete, key, url.Values{"uploadId": {uploadId}}, nil, nil)
+	}
+
+	var complete completeMultipartUpload
+	buf := make([]byte, b.opts.PartSize)
+	for offset, part := int64(0), 1; offset < size; offset, part = offset+b.opts.PartSize, part+1 {
+		n, err := r.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			abort()
+			return err
+		}
+
+		query := url.Values{
+			"partNumber": {strconv.Itoa(part)},
+			"uploadId":   {uploadId},
+		}
+		etag, err := b.uploadPart(ctx, key, query, buf[:n])
+		if err != nil {
+			abort()
+			return err
+		}
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: part, ETag: etag})
+	}
+
+	body, err := xml.Marshal(&complete)
+	if err != nil {
+		abort()
+		return err
+	}
+
+	resp, err = b.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadId}}, body, nil)
+	if err != nil {
+		abort()
+		return err
+	}
+	// S3 can answer 200 and still fail the completion
+	if bytes.Contains(resp, []byte("<Error>")) {
+		abort()
+		return fmt.Errorf("complete multipart upload failed: %s", resp)
+	}
+	return nil
+}
+
+func (b *S3Backend) uploadPart(ctx context.Context, key string, query url.Values, data []byte) (string, error) {
+	req, err := b.newRequest(ctx, http.MethodPut, key, query, data, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("s3 upload part failed: %s %s", resp.Status, body)
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+func (b *S3Backend) do(ctx context.Context, method, key string, query url.Values, data []byte, metadata map[string]string) ([]byte, error) {
+	req, err := b.newRequest(ctx, method, key, query, data, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("s3 %s %s failed: %s %s", method, key, resp.Status, body)
+	}
+	return body, nil
+}
+
+func (b *S3Backend) newRequest(ctx context.Context, method, key string, query url.Values, data []byte, metadata map[string]string) (*http.Request, error) {
+	u := b.objectURL(key, query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = int64(len(data))
+	for k, v := range metadata {
+		req.Header.Set("X-Amz-Meta-"+k, v)
+	}
+
+	b.sign(req, u, data, time.Now().UTC())
+	return req, nil
+}
+
+// sign adds the AWS signature V4 authorization of the request.
+func (b *S3Backend) sign(req *http.Request, u *url.URL, data []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(data)
+
+	req.Header.Set("Host", u.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// every x-amz-* header has to be signed, metadata included
+	headers := []string{"host"}
+	values := map[string]string{"host": u.Host}
+	for k := range req.Header {
+		if name := strings.ToLower(k); strings.HasPrefix(name, "x-amz-") {
+			headers = append(headers, name)
+			values[name] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	sort.Strings(headers)
+
+	var canonicalHeaders string
+	for _, name := range headers {
+		canonicalHeaders += name + ":" + values[name] + "\n"
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		u.RawPath,
+		u.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + b.opts.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+b.opts.SecretKey), date)
+	key = hmacSHA256(key, b.opts.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.opts.AccessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// encodePath escapes every path segment as required by signature V4.
+func encodePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// encodeQuery returns the canonical query string, sorted by key.
+func encodeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func uriEncode(s string) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
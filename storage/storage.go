@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"chrome_render/config"
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+)
+
+var conf = config.GetConfig()
+
+// Backend stores the files produced by the writers, recordings and frames.
+type Backend interface {
+	Name() string
+
+	// Upload stores the local file under key with the metadata of the task
+	// and returns its location.
+	Upload(ctx context.Context, key, localPath string, metadata map[string]string) (string, error)
+
+	// Delete removes the object stored under key.
+	Delete(ctx context.Context, key string) error
+
+	// IsLocal reports whether the uploaded location is the local file itself.
+	IsLocal() bool
+}
+
+var (
+	backendOnce sync.Once
+	backend     Backend
+)
+
+// Default returns the backend selected by the storage config.
+func Default() Backend {
+	backendOnce.Do(func() {
+		var err error
+		if backend, err = NewBackend(*conf.StorageType); err != nil {
+			logrus.WithError(err).Errorln("create storage backend failed, fall back to local disk")
+			backend = &LocalBackend{}
+		}
+		logrus.Printf("storage backend: %s", backend.Name())
+	})
+
+	return backend
+}
+
+// NewBackend creates the backend of a storage type. An empty type uploads to the record domain when its address is set and
+// keeps the files on the local disk otherwise.
+func NewBackend(storageType string) (Backend, error) {
+	if storageType == "" && *conf.RecordDomainAddr != "" {
+		storageType = "record-domain"
+	}
+
+	switch storageType {
+	case "", "local":
+		if *conf.RecordDomainAddr != "" {
+			logrus.Warnln("record domain set but unused, recordings are kept by the local storage")
+		}
+		return &LocalBackend{}, nil
+	case "record-domain":
+		return NewHTTPBackend(*conf.RecordDomainAddr, int64(*conf.UploadChunkSize)<<20)
+	case "s3":
+		return NewS3Backend(S3Options{
+			Endpoint:  *conf.S3Endpoint,
+			Region:    *conf.S3Region,
+			Bucket:    *conf.S3Bucket,
+			AccessKey: *conf.S3AccessKey,
+			SecretKey: *conf.S3SecretKey,
+			Prefix:    *conf.S3Prefix,
+			PathStyle: *conf.S3PathStyle,
+			PartSize:  int64(*conf.S3PartSize) << 20,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage type: %s", storageType)
+	}
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	uploadWorkers   = 2
+	uploadQueueSize = 1024
+	maxRetryDelay   = time.Minute
+)
+
+// Job is a closed file waiting to be stored.
+type Job struct {
+	Key       string
+	LocalPath string
+	Metadata  map[string]string
+
+	// OnDone is called with the location of the stored file or the error of
+	// the last attempt.
+	OnDone func(location string, err error)
+}
+
+// ErrQueueFull is the result of a job submitted while the upload queue is
+// full, its file stays on the local disk.
+var ErrQueueFull = errors.New("upload queue is full")
+
+var (
+	uploaderOnce sync.Once
+	chJobs       chan *Job
+	overflows    int64
+)
+
+// Submit queues a closed file for upload to the default backend. The local
+// copy is deleted once a remote backend confirmed the upload, unless the
+// config keeps local copies. Submit never blocks: when the backend falls so
+// far behind that the queue is full, the job fails at once with ErrQueueFull.
+func Submit(job *Job) {
+	uploaderOnce.Do(func() {
+		chJobs = make(chan *Job, uploadQueueSize)
+		for i := 0; i < uploadWorkers; i++ {
+			go uploadLoop()
+		}
+	})
+
+	select {
+	case chJobs <- job:
+		return
+	default:
+	}
+
+	// log the first overflow and then every 100th, frames overflow fast
+	if n := atomic.AddInt64(&overflows, 1); n%100 == 1 {
+		logrus.Warnf("upload queue is full, %s kept locally, %d files not queued so far", job.LocalPath, n)
+	}
+	if job.OnDone != nil {
+		job.OnDone("", ErrQueueFull)
+	}
+}
+
+func uploadLoop() {
+	for job := range chJobs {
+		location, err := upload(Default(), job)
+		if job.OnDone != nil {
+			job.OnDone(location, err)
+		}
+	}
+}
+
+func upload(b Backend, job *Job) (string, error) {
+	var location string
+	var err error
+
+	delay := time.Second
+	for attempt := 0; attempt <= *conf.StorageRetries; attempt++ {
+		if attempt > 0 {
+			logrus.WithError(err).Warnf("upload %s failed, retry in %s", job.LocalPath, delay)
+			time.Sleep(delay)
+			if delay *= 2; delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		}
+
+		location, err = b.Upload(context.Background(), job.Key, job.LocalPath, job.Metadata)
+		if err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		logrus.WithError(err).Errorf("upload %s to %s failed, keep local copy", job.LocalPath, b.Name())
+		return "", err
+	}
+
+	if !b.IsLocal() {
+		logrus.Printf("uploaded %s to %s", job.LocalPath, location)
+		if !*conf.StorageKeepLocal {
+			if err := os.Remove(job.LocalPath); err != nil {
+				logrus.WithError(err).Warnf("delete uploaded local copy %s failed", job.LocalPath)
+			}
+		}
+	}
+
+	return location, nil
+}
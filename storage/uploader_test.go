@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubmitQueueFull(t *testing.T) {
+	// a queue without room and without workers
+	uploaderOnce.Do(func() {
+		chJobs = make(chan *Job)
+	})
+
+	result := make(chan error, 1)
+	submitted := make(chan struct{})
+	go func() {
+		Submit(&Job{
+			LocalPath: "frames/a/1.jpg",
+			OnDone: func(location string, err error) {
+				result <- err
+			},
+		})
+		close(submitted)
+	}()
+
+	select {
+	case <-submitted:
+	case <-time.After(time.Second):
+		t.Fatal("Submit blocked on a full queue")
+	}
+	if err := <-result; err != ErrQueueFull {
+		t.Errorf("job failed with %v, want ErrQueueFull", err)
+	}
+}
@@ -0,0 +1,106 @@
+package thumbnail
+
+import (
+	"bytes"
+	"chrome_render/catalog"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const vttName = "thumbnails.vtt"
+
+// Generate tiles the thumbnails of a finished recording into sprite jpegs
+// and writes a WebVTT track whose cues point at the sprite coordinates, as
+// used by the scrub bar of players. The screencast frames of the task are
+// used when it has a screencast, only a task without one has its file
+// decoded by ffmpeg. It returns the track and the sprites, written to a
+// directory per recording.
+func Generate(rec *catalog.Recording) (string, []string, error) {
+	tiles, ok := takeTiles(rec.TaskName, rec.StartTime, rec.EndTime)
+	if !ok {
+		var err error
+		if tiles, err = decodeTiles(rec.Path, rec.StartTime); err != nil {
+			return "", nil, err
+		}
+	}
+	if len(tiles) == 0 {
+		return "", nil, nil
+	}
+
+	dir := filepath.Join(*conf.ThumbnailPath, rec.Id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, err
+	}
+
+	width, height := tileSize()
+	columns, rows := *conf.SpriteColumns, *conf.SpriteRows
+	perSprite := columns * rows
+
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n")
+	var sprites []string
+	for first := 0; first < len(tiles); first += perSprite {
+		last := first + perSprite
+		if last > len(tiles) {
+			last = len(tiles)
+		}
+
+		count := last - first
+		spriteColumns := columns
+		if count < columns {
+			spriteColumns = count
+		}
+		spriteRows := (count + columns - 1) / columns
+		sprite := image.NewRGBA(image.Rect(0, 0, spriteColumns*width, spriteRows*height))
+
+		name := fmt.Sprintf("sprite-%d.jpg", len(sprites))
+		for i, t := range tiles[first:last] {
+			img, err := jpeg.Decode(bytes.NewReader(t.data))
+			if err != nil {
+				return "", nil, err
+			}
+			x, y := i%columns*width, i/columns*height
+			draw.Draw(sprite, image.Rect(x, y, x+width, y+height), img, img.Bounds().Min, draw.Src)
+
+			start := t.time.Sub(rec.StartTime)
+			end := start + interval()
+			if next := first + i + 1; next < len(tiles) {
+				end = tiles[next].time.Sub(rec.StartTime)
+			} else if duration := rec.EndTime.Sub(rec.StartTime); end > duration && duration > start {
+				end = duration
+			}
+			fmt.Fprintf(&vtt, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n", vttTime(start), vttTime(end), name, x, y, width, height)
+		}
+
+		path := filepath.Join(dir, name)
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, sprite, &jpeg.Options{Quality: tileQuality}); err != nil {
+			return "", nil, err
+		}
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			return "", nil, err
+		}
+		sprites = append(sprites, path)
+	}
+
+	vttPath := filepath.Join(dir, vttName)
+	if err := ioutil.WriteFile(vttPath, []byte(vtt.String()), 0644); err != nil {
+		return "", nil, err
+	}
+	return vttPath, sprites, nil
+}
+
+func vttTime(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,231 @@
+package thumbnail
+
+import (
+	"bufio"
+	"bytes"
+	"chrome_render/config"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	tileQuality = 80
+
+	// screencast tiles waiting for their recording, per task
+	maxTiles = 4096
+)
+
+var conf = config.GetConfig()
+
+// tile is one sampled thumbnail, kept jpeg encoded until it is tiled.
+type tile struct {
+	time time.Time
+	data []byte
+}
+
+type sampler struct {
+	lock       sync.Mutex
+	lastSample time.Time
+	tiles      []tile
+	// last is the latest tile taken, the page still shows it while the
+	// screencast sends no new frame
+	last *tile
+}
+
+var (
+	samplersLock sync.Mutex
+	samplers     = map[string]*sampler{}
+)
+
+// Enabled reports whether thumbnails are configured.
+func Enabled() bool {
+	return *conf.ThumbnailInterval > 0
+}
+
+func interval() time.Duration {
+	return time.Duration(*conf.ThumbnailInterval) * time.Second
+}
+
+// tileSize is the thumbnail size, following the aspect ratio of the video.
+func tileSize() (int, int) {
+	width := *conf.ThumbnailWidth
+	height := width * 9 / 16
+	if *conf.VideoWidth > 0 && *conf.VideoHeight > 0 {
+		height = width * *conf.VideoHeight / *conf.VideoWidth
+	}
+	return width, height &^ 1
+}
+
+func getSampler(taskName string) *sampler {
+	samplersLock.Lock()
+	defer samplersLock.Unlock()
+
+	s, ok := samplers[taskName]
+	if !ok {
+		s = &sampler{}
+		samplers[taskName] = s
+	}
+	return s
+}
+
+// AddFrame offers a screencast frame of the task. One frame per interval is
+// scaled down and kept for the recording it belongs to.
+func AddFrame(taskName string, jpg []byte, t time.Time) {
+	if !Enabled() {
+		return
+	}
+
+	s := getSampler(taskName)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if t.Sub(s.lastSample) < interval() {
+		return
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(jpg))
+	if err != nil {
+		logrus.WithError(err).Debugf("decode screencast frame failed. task name: %s", taskName)
+		return
+	}
+	data, err := encodeTile(scale(img))
+	if err != nil {
+		logrus.WithError(err).Warnf("encode thumbnail failed. task name: %s", taskName)
+		return
+	}
+
+	s.lastSample = t
+	s.tiles = append(s.tiles, tile{time: t, data: data})
+	if len(s.tiles) > maxTiles {
+		s.tiles = s.tiles[len(s.tiles)-maxTiles:]
+	}
+}
+
+// takeTiles returns the screencast tiles sampled between from and to and
+// forgets every tile older than to. A range without a new frame shows the
+// last frame before it, ok is false only when the task has no screencast.
+func takeTiles(taskName string, from, to time.Time) (tiles []tile, ok bool) {
+	s := getSampler(taskName)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	before := s.last
+	n := 0
+	for _, t := range s.tiles {
+		if t.time.After(to) {
+			break
+		}
+		if !t.time.Before(from) {
+			tiles = append(tiles, t)
+		} else {
+			before = &s.tiles[n]
+		}
+		n++
+	}
+	if len(tiles) > 0 {
+		s.last = &tile{time: tiles[len(tiles)-1].time, data: tiles[len(tiles)-1].data}
+	} else if before != nil {
+		s.last = &tile{time: before.time, data: before.data}
+	}
+	s.tiles = s.tiles[n:]
+
+	if (len(tiles) == 0 || tiles[0].time.After(from)) && before != nil {
+		tiles = append([]tile{{time: from, data: before.data}}, tiles...)
+	}
+	return tiles, len(tiles) > 0
+}
+
+// scale resizes img to the tile size, averaging the source pixels each tile
+// pixel covers.
+func scale(img image.Image) *image.RGBA {
+	width, height := tileSize()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	src := img.Bounds()
+
+	for y := 0; y < height; y++ {
+		y0 := src.Min.Y + y*src.Dy()/height
+		y1 := src.Min.Y + (y+1)*src.Dy()/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := src.Min.X + x*src.Dx()/width
+			x1 := src.Min.X + (x+1)*src.Dx()/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, _ := img.At(sx, sy).RGBA()
+					r, g, b, n = r+cr, g+cg, b+cb, n+1
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(b / n >> 8)
+			dst.Pix[i+3] = 0xff
+		}
+	}
+	return dst
+}
+
+func encodeTile(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: tileQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeTiles samples the recording file with ffmpeg, for recordings made
+// without screencast frames.
+func decodeTiles(path string, start time.Time) ([]tile, error) {
+	ffmpeg, err := exec.LookPath(*conf.FfmpegPath)
+	if err != nil {
+		return nil, err
+	}
+
+	width, height := tileSize()
+	filter := fmt.Sprintf("fps=1/%d,scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2",
+		*conf.ThumbnailInterval, width, height, width, height)
+	cmd := exec.Command(ffmpeg, "-hide_banner", "-loglevel", "error",
+		"-i", path, "-an", "-vf", filter,
+		"-f", "rawvideo", "-pix_fmt", "rgba", "pipe:1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var tiles []tile
+	reader := bufio.NewReader(stdout)
+	for i := 0; ; i++ {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		if _, err = io.ReadFull(reader, img.Pix); err != nil {
+			break
+		}
+		data, err := encodeTile(img)
+		if err != nil {
+			break
+		}
+		tiles = append(tiles, tile{time: start.Add(time.Duration(i) * interval()), data: data})
+	}
+	io.Copy(ioutil.Discard, reader)
+
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+	return tiles, nil
+}
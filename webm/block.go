@@ -0,0 +1,60 @@
+package webm
+
+// Block is the header of a SimpleBlock or Block element.
+type Block struct {
+	Track    uint64
+	Timecode int16
+	Flags    byte
+	Payload  []byte
+}
+
+// Keyframe reports the SimpleBlock keyframe flag.
+func (b *Block) Keyframe() bool {
+	return b.Flags&0x80 != 0
+}
+
+// ParseBlock decodes the payload of a SimpleBlock or Block element.
+func ParseBlock(data []byte) (*Block, error) {
+	track, n, _, err := readVint(data, 8, false)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || len(data) < n+3 {
+		return nil, ErrInvalid
+	}
+
+	return &Block{
+		Track:    track,
+		Timecode: int16(uint16(data[n])<<8 | uint16(data[n+1])),
+		Flags:    data[n+2],
+		Payload:  data[n+3:],
+	}, nil
+}
+
+// ParseBlockGroup returns the Block held by a BlockGroup payload.
+func ParseBlockGroup(data []byte) (*Block, error) {
+	children, err := Children(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, child := range children {
+		if child.ID == IDBlock {
+			return ParseBlock(child.Data)
+		}
+	}
+	return nil, ErrInvalid
+}
+
+// ParseInfoTimecodeScale returns the TimecodeScale of an Info payload.
+func ParseInfoTimecodeScale(data []byte) uint64 {
+	children, _ := Children(data)
+	for _, child := range children {
+		if child.ID == IDTimecodeScale {
+			if scale := ReadUint(child.Data); scale > 0 {
+				return scale
+			}
+		}
+	}
+	return DefaultTimecodeScale
+}
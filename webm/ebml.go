@@ -0,0 +1,213 @@
+package webm
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Matroska/WebM element IDs used by the recording pipeline.
+const (
+	IDEBML        = 0x1A45DFA3
+	IDSegment     = 0x18538067
+	IDSeekHead    = 0x114D9B74
+	IDInfo        = 0x1549A966
+	IDTracks      = 0x1654AE6B
+	IDCluster     = 0x1F43B675
+	IDCues        = 0x1C53BB6B
+	IDTags        = 0x1254C367
+	IDChapters    = 0x1043A770
+	IDAttachments = 0x1941A469
+	IDVoid        = 0xEC
+	IDCRC32       = 0xBF
+
+	IDTimecodeScale = 0x2AD7B1
+	IDDuration      = 0x4489
+
+	IDTrackEntry  = 0xAE
+	IDTrackNumber = 0xD7
+	IDTrackType   = 0x83
+	IDCodecID     = 0x86
+
+	IDTimecode    = 0xE7
+	IDSimpleBlock = 0xA3
+	IDBlockGroup  = 0xA0
+	IDBlock       = 0xA1
+)
+
+// UnknownSize is the Size of a master element written in live mode,
+// whose end is only known when the next sibling starts.
+const UnknownSize = -1
+
+// DefaultTimecodeScale is the Matroska default, one tick per millisecond.
+const DefaultTimecodeScale = 1000000
+
+var ErrInvalid = errors.New("webm: invalid ebml data")
+
+var unknownSizeVint = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// readVint decodes a variable length integer at the start of b.
+// n is 0 when b does not hold the whole integer yet.
+func readVint(b []byte, maxLen int, keepMarker bool) (v uint64, n int, unknown bool, err error) {
+	if len(b) == 0 {
+		return 0, 0, false, nil
+	}
+
+	first := b[0]
+	length := 1
+	for mask := byte(0x80); length <= maxLen && first&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > maxLen {
+		return 0, 0, false, ErrInvalid
+	}
+	if len(b) < length {
+		return 0, 0, false, nil
+	}
+
+	v = uint64(first)
+	if !keepMarker {
+		v &= uint64(0xFF >> uint(length))
+	}
+	allOnes := v == uint64(0xFF>>uint(length))
+	for i := 1; i < length; i++ {
+		v = v<<8 | uint64(b[i])
+		allOnes = allOnes && b[i] == 0xFF
+	}
+
+	return v, length, !keepMarker && allOnes, nil
+}
+
+// ReadElementHeader decodes the ID and size of the element at the start of b.
+// n is 0 when b does not hold the whole header yet.
+func ReadElementHeader(b []byte) (id uint32, size int64, n int, err error) {
+	idv, n1, _, err := readVint(b, 4, true)
+	if err != nil || n1 == 0 {
+		return 0, 0, 0, err
+	}
+
+	sv, n2, unknown, err := readVint(b[n1:], 8, false)
+	if err != nil || n2 == 0 {
+		return 0, 0, 0, err
+	}
+
+	size = int64(sv)
+	if unknown {
+		size = UnknownSize
+	} else if size < 0 {
+		return 0, 0, 0, ErrInvalid
+	}
+
+	return uint32(idv), size, n1 + n2, nil
+}
+
+// AppendID appends the encoded element id to b.
+func AppendID(b []byte, id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return append(b, byte(id>>24), byte(id>>16), byte(id>>8), byte(id))
+	case id > 0xFFFF:
+		return append(b, byte(id>>16), byte(id>>8), byte(id))
+	case id > 0xFF:
+		return append(b, byte(id>>8), byte(id))
+	default:
+		return append(b, byte(id))
+	}
+}
+
+// AppendSize appends size as a vint, or the reserved unknown size marker.
+func AppendSize(b []byte, size int64) []byte {
+	if size < 0 {
+		return append(b, unknownSizeVint...)
+	}
+
+	length := 1
+	for length < 8 && uint64(size) >= (uint64(1)<<uint(7*length))-1 {
+		length++
+	}
+
+	v := uint64(size) | uint64(1)<<uint(7*length)
+	for i := length - 1; i >= 0; i-- {
+		b = append(b, byte(v>>uint(8*i)))
+	}
+	return b
+}
+
+// AppendElement appends a complete element with the given payload to b.
+func AppendElement(b []byte, id uint32, data []byte) []byte {
+	b = AppendID(b, id)
+	b = AppendSize(b, int64(len(data)))
+	return append(b, data...)
+}
+
+// AppendMasterStart appends the header of a master element of unknown size.
+func AppendMasterStart(b []byte, id uint32) []byte {
+	return AppendSize(AppendID(b, id), UnknownSize)
+}
+
+// AppendUint appends an unsigned integer element using the shortest encoding.
+func AppendUint(b []byte, id uint32, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+
+	i := 0
+	for i < 7 && buf[i] == 0 {
+		i++
+	}
+	return AppendElement(b, id, buf[i:])
+}
+
+// AppendFloat appends a 64-bit float element.
+func AppendFloat(b []byte, id uint32, v float64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], math.Float64bits(v))
+	return AppendElement(b, id, buf[:])
+}
+
+// ReadUint decodes the payload of an unsigned integer element.
+func ReadUint(data []byte) uint64 {
+	var v uint64
+	for _, c := range data {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// ReadFloat decodes the payload of a float element.
+func ReadFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	default:
+		return 0
+	}
+}
+
+// Children splits the payload of a complete master element into its children.
+func Children(data []byte) ([]Element, error) {
+	var elements []Element
+
+	for pos := 0; pos < len(data); {
+		id, size, n, err := ReadElementHeader(data[pos:])
+		if err != nil {
+			return elements, err
+		}
+		if n == 0 || size < 0 || int64(len(data)-pos-n) < size {
+			return elements, ErrInvalid
+		}
+
+		end := pos + n + int(size)
+		elements = append(elements, Element{
+			ID:        id,
+			Size:      size,
+			Data:      data[pos+n : end],
+			Offset:    int64(pos),
+			HeaderLen: n,
+		})
+		pos = end
+	}
+
+	return elements, nil
+}
@@ -0,0 +1,232 @@
+package webm
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Cue element IDs.
+const (
+	IDSeek               = 0x4DBB
+	IDSeekID             = 0x53AB
+	IDSeekPosition       = 0x53AC
+	IDCuePoint           = 0xBB
+	IDCueTime            = 0xB3
+	IDCueTrackPositions  = 0xB7
+	IDCueTrack           = 0xF7
+	IDCueClusterPosition = 0xF1
+)
+
+const scanChunkSize = 1 << 20
+
+// ClusterInfo is a cluster found by Scan.
+type ClusterInfo struct {
+	Offset       int64
+	Timecode     int64
+	LastTimecode int64
+	Keyframe     bool
+}
+
+// Index describes a webm file as found by Scan, offsets are file offsets.
+type Index struct {
+	EBML          []byte
+	Info          []byte
+	Tracks        []byte
+	TimecodeScale uint64
+	VideoTrack    uint64
+	CueTrack      uint64
+	Clusters      []ClusterInfo
+
+	// End is the offset right after the last complete element.
+	End int64
+	// Truncated is set when the file ends inside an element.
+	Truncated bool
+}
+
+// Scan reads a webm file and indexes its header and clusters. A file that
+// ends inside an element, e.g. after a crash, is not an error: the index
+// reports it as Truncated.
+func Scan(r io.Reader) (*Index, error) {
+	idx := &Index{TimecodeScale: DefaultTimecodeScale}
+	var cluster *ClusterInfo
+	videoSeen := false
+
+	p := NewParser(func(el *Element) error {
+		switch {
+		case el.ID == IDEBML && el.Level == 0:
+			idx.EBML = AppendElement(nil, el.ID, el.Data)
+		case el.ID == IDInfo:
+			idx.Info = append([]byte(nil), el.Data...)
+			idx.TimecodeScale = ParseInfoTimecodeScale(el.Data)
+		case el.ID == IDTracks:
+			idx.Tracks = AppendElement(nil, el.ID, el.Data)
+			if tracks, err := ParseTracks(el.Data); err == nil {
+				if track, ok := FindTrack(tracks, TrackTypeVideo); ok {
+					idx.VideoTrack = track.Number
+				}
+				if len(tracks) > 0 {
+					idx.CueTrack = tracks[0].Number
+				}
+			}
+			if idx.VideoTrack != 0 {
+				idx.CueTrack = idx.VideoTrack
+			}
+		case el.ID == IDCluster:
+			idx.Clusters = append(idx.Clusters, ClusterInfo{Offset: el.Offset})
+			cluster = &idx.Clusters[len(idx.Clusters)-1]
+			videoSeen = false
+		case el.ID == IDTimecode && el.Level == 2 && cluster != nil:
+			cluster.Timecode = int64(ReadUint(el.Data))
+			cluster.LastTimecode = cluster.Timecode
+		case (el.ID == IDSimpleBlock || el.ID == IDBlockGroup) && cluster != nil:
+			var block *Block
+			var err error
+			if el.ID == IDSimpleBlock {
+				block, err = ParseBlock(el.Data)
+			} else {
+				block, err = ParseBlockGroup(el.Data)
+			}
+			if err != nil {
+				break
+			}
+			if timecode := cluster.Timecode + int64(block.Timecode); timecode > cluster.LastTimecode {
+				cluster.LastTimecode = timecode
+			}
+			if !videoSeen && (idx.VideoTrack == 0 || block.Track == idx.VideoTrack) {
+				videoSeen = true
+				cluster.Keyframe = el.ID == IDSimpleBlock && block.Keyframe()
+			}
+		}
+
+		if el.Master {
+			idx.End = el.Offset + int64(el.HeaderLen)
+		} else {
+			idx.End = el.Offset + int64(el.HeaderLen) + el.Size
+		}
+		return nil
+	})
+
+	buf := make([]byte, scanChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, perr := p.Write(buf[:n]); perr != nil {
+				// garbage after a crash, keep what parsed so far
+				idx.Truncated = true
+				return idx, nil
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return idx, err
+		}
+	}
+
+	idx.Truncated = p.Buffered() > 0
+	return idx, nil
+}
+
+// Trim drops the last cluster of a truncated file, it may miss blocks.
+func (idx *Index) Trim() {
+	if !idx.Truncated || len(idx.Clusters) == 0 {
+		return
+	}
+
+	last := idx.Clusters[len(idx.Clusters)-1]
+	idx.End = last.Offset
+	idx.Clusters = idx.Clusters[:len(idx.Clusters)-1]
+}
+
+// Duration returns the duration in timecode ticks.
+func (idx *Index) Duration() int64 {
+	var last int64
+	for _, cluster := range idx.Clusters {
+		if cluster.LastTimecode > last {
+			last = cluster.LastTimecode
+		}
+	}
+	return last
+}
+
+func appendUintFixed(b []byte, id uint32, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return AppendElement(b, id, buf[:])
+}
+
+// WriteFinal writes the indexed clusters of src to dst as a seekable file:
+// the Info gets a Duration, Cues point at the keyframe clusters and a
+// SeekHead points at Info, Tracks and Cues.
+func WriteFinal(dst io.Writer, src io.ReaderAt, idx *Index) error {
+	if len(idx.EBML) == 0 || len(idx.Tracks) == 0 {
+		return ErrInvalid
+	}
+
+	var info []byte
+	children, _ := Children(idx.Info)
+	for _, child := range children {
+		if child.ID != IDDuration {
+			info = AppendElement(info, child.ID, child.Data)
+		}
+	}
+	info = AppendFloat(info, IDDuration, float64(idx.Duration()))
+	info = AppendElement(nil, IDInfo, info)
+
+	var clustersStart, clustersEnd int64
+	if len(idx.Clusters) > 0 {
+		clustersStart = idx.Clusters[0].Offset
+		clustersEnd = idx.End
+	}
+
+	seekHead := func(infoPos, tracksPos, cuesPos uint64) []byte {
+		var seeks []byte
+		for _, seek := range []struct {
+			id  uint32
+			pos uint64
+		}{{IDInfo, infoPos}, {IDTracks, tracksPos}, {IDCues, cuesPos}} {
+			entry := AppendElement(nil, IDSeekID, AppendID(nil, seek.id))
+			entry = appendUintFixed(entry, IDSeekPosition, seek.pos)
+			seeks = AppendElement(seeks, IDSeek, entry)
+		}
+		return AppendElement(nil, IDSeekHead, seeks)
+	}
+
+	headSize := int64(len(seekHead(0, 0, 0)))
+	infoPos := headSize
+	tracksPos := infoPos + int64(len(info))
+	clustersPos := tracksPos + int64(len(idx.Tracks))
+	cuesPos := clustersPos + clustersEnd - clustersStart
+
+	var cues []byte
+	for _, cluster := range idx.Clusters {
+		if !cluster.Keyframe && idx.VideoTrack != 0 {
+			continue
+		}
+		positions := AppendUint(nil, IDCueTrack, idx.CueTrack)
+		positions = AppendUint(positions, IDCueClusterPosition, uint64(clustersPos+cluster.Offset-clustersStart))
+		point := AppendUint(nil, IDCueTime, uint64(cluster.Timecode))
+		point = AppendElement(point, IDCueTrackPositions, positions)
+		cues = AppendElement(cues, IDCuePoint, point)
+	}
+	cues = AppendElement(nil, IDCues, cues)
+
+	segmentSize := cuesPos + int64(len(cues))
+	head := append([]byte(nil), idx.EBML...)
+	head = AppendSize(AppendID(head, IDSegment), segmentSize)
+	head = append(head, seekHead(uint64(infoPos), uint64(tracksPos), uint64(cuesPos))...)
+	head = append(head, info...)
+	head = append(head, idx.Tracks...)
+
+	if _, err := dst.Write(head); err != nil {
+		return err
+	}
+	if clustersEnd > clustersStart {
+		if _, err := io.Copy(dst, io.NewSectionReader(src, clustersStart, clustersEnd-clustersStart)); err != nil {
+			return err
+		}
+	}
+	_, err := dst.Write(cues)
+	return err
+}
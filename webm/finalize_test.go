@@ -0,0 +1,162 @@
+package webm
+
+import (
+	"bytes"
+	"testing"
+)
+
+// recording is a live stream of clusters a second apart, each with a frame
+// at its start and half a second later. The cluster at 1000 starts with a
+// delta frame.
+func recording() []byte {
+	b := AppendMasterStart(header(), IDSegment)
+	b = append(append(b, info()...), tracks()...)
+	for _, timecode := range []uint64{0, 1000, 2000, 3000} {
+		flags := byte(0x80)
+		if timecode == 1000 {
+			flags = 0
+		}
+		b = AppendMasterStart(b, IDCluster)
+		b = AppendUint(b, IDTimecode, timecode)
+		b = AppendElement(b, IDSimpleBlock, []byte{0x81, 0, 0, flags, 'a'})
+		b = AppendElement(b, IDSimpleBlock, []byte{0x81, 0x01, 0xf4, 0, 'b'})
+	}
+	return b
+}
+
+type cuePoint struct {
+	time     uint64
+	track    uint64
+	position uint64
+}
+
+// final is what a player reads from a finalized file.
+type final struct {
+	duration float64
+	clusters map[uint64]uint64 // timecode by position in the segment
+	cues     []cuePoint
+}
+
+func readFinal(t *testing.T, data []byte) *final {
+	f := &final{clusters: map[uint64]uint64{}}
+	var segmentStart, cluster int64
+	p := NewParser(func(el *Element) error {
+		switch {
+		case el.ID == IDSegment:
+			if el.Size < 0 {
+				t.Error("finalized segment has an unknown size")
+			}
+			segmentStart = el.Offset + int64(el.HeaderLen)
+		case el.ID == IDCluster:
+			cluster = el.Offset - segmentStart
+		case el.ID == IDTimecode && el.Level == 2:
+			f.clusters[uint64(cluster)] = ReadUint(el.Data)
+		case el.ID == IDInfo:
+			children, err := Children(el.Data)
+			if err != nil {
+				return err
+			}
+			for _, child := range children {
+				if child.ID == IDDuration {
+					f.duration = ReadFloat(child.Data)
+				}
+			}
+		case el.ID == IDCues:
+			points, err := Children(el.Data)
+			if err != nil {
+				return err
+			}
+			for _, point := range points {
+				var cue cuePoint
+				children, _ := Children(point.Data)
+				for _, child := range children {
+					switch child.ID {
+					case IDCueTime:
+						cue.time = ReadUint(child.Data)
+					case IDCueTrackPositions:
+						positions, _ := Children(child.Data)
+						for _, position := range positions {
+							switch position.ID {
+							case IDCueTrack:
+								cue.track = ReadUint(position.Data)
+							case IDCueClusterPosition:
+								cue.position = ReadUint(position.Data)
+							}
+						}
+					}
+				}
+				f.cues = append(f.cues, cue)
+			}
+		}
+		return nil
+	})
+	if _, err := p.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if p.Buffered() != 0 {
+		t.Error("finalized file ends inside an element")
+	}
+	return f
+}
+
+func TestFinalizeTruncated(t *testing.T) {
+	data := recording()
+	// the process died while the last cluster was written
+	truncated := data[:len(data)-3]
+
+	idx, err := Scan(bytes.NewReader(truncated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !idx.Truncated || len(idx.Clusters) != 4 {
+		t.Fatalf("scan found %d clusters, truncated %v", len(idx.Clusters), idx.Truncated)
+	}
+	partial := idx.Clusters[3].Offset
+	idx.Trim()
+	if len(idx.Clusters) != 3 {
+		t.Fatalf("%d clusters kept, want the last one dropped", len(idx.Clusters))
+	}
+	if idx.End != partial {
+		t.Errorf("index ends at %d, want %d where the partial cluster starts", idx.End, partial)
+	}
+
+	var out bytes.Buffer
+	if err := WriteFinal(&out, bytes.NewReader(truncated), idx); err != nil {
+		t.Fatal(err)
+	}
+	f := readFinal(t, out.Bytes())
+
+	if f.duration != 2500 {
+		t.Errorf("duration %v, want 2500", f.duration)
+	}
+	if len(f.clusters) != 3 {
+		t.Errorf("%d clusters written, want 3", len(f.clusters))
+	}
+	// no cue for the cluster starting with a delta frame
+	if len(f.cues) != 2 {
+		t.Fatalf("cues %+v, want the keyframe clusters at 0 and 2000", f.cues)
+	}
+	for n, want := range []uint64{0, 2000} {
+		cue := f.cues[n]
+		if cue.time != want || cue.track != 1 {
+			t.Errorf("cue %d at %d on track %d, want %d on track 1", n, cue.time, cue.track, want)
+		}
+		if timecode, ok := f.clusters[cue.position]; !ok || timecode != cue.time {
+			t.Errorf("cue %d points at %d, no cluster at %d there", n, cue.position, cue.time)
+		}
+	}
+}
+
+func TestScanComplete(t *testing.T) {
+	idx, err := Scan(bytes.NewReader(recording()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Trim()
+	if idx.Truncated || len(idx.Clusters) != 4 {
+		t.Errorf("complete file scanned as %d clusters, truncated %v", len(idx.Clusters), idx.Truncated)
+	}
+	if idx.Duration() != 3500 {
+		t.Errorf("duration %d, want 3500", idx.Duration())
+	}
+}
@@ -0,0 +1,174 @@
+package webm
+
+import "errors"
+
+// DefaultMaxElementSize bounds how much a Parser buffers for one element.
+const DefaultMaxElementSize = 64 << 20
+
+var ErrElementTooLarge = errors.New("webm: element exceeds size limit")
+
+// Element is one EBML element found in a stream. Segment and Cluster are
+// reported as Master with a nil Data when they start, their children follow
+// as separate elements; every other element is reported complete.
+type Element struct {
+	ID        uint32
+	Size      int64
+	Data      []byte
+	Master    bool
+	Level     int
+	Offset    int64
+	HeaderLen int
+}
+
+// End returns the stream offset right after the element, or -1 for masters
+// of unknown size.
+func (e *Element) End() int64 {
+	if e.Size < 0 {
+		return -1
+	}
+	return e.Offset + int64(e.HeaderLen) + e.Size
+}
+
+type openMaster struct {
+	id  uint32
+	end int64
+}
+
+// Parser splits a WebM byte stream arriving in arbitrary chunks into
+// elements, descending into Segment and Cluster so that live streams with
+// unknown-size masters can be processed while they are still being written.
+type Parser struct {
+	MaxElementSize int64
+
+	handler func(*Element) error
+	buf     []byte
+	pos     int64
+	stack   []openMaster
+}
+
+func NewParser(handler func(*Element) error) *Parser {
+	return &Parser{
+		MaxElementSize: DefaultMaxElementSize,
+		handler:        handler,
+	}
+}
+
+// Offset returns the stream offset of the first byte not yet parsed.
+func (p *Parser) Offset() int64 {
+	return p.pos
+}
+
+// Buffered returns the number of bytes waiting for an element to complete.
+func (p *Parser) Buffered() int {
+	return len(p.buf)
+}
+
+// Write feeds the next chunk of the stream to the parser. The handler is
+// called for every element completed by this chunk; Element.Data is only
+// valid during the call.
+func (p *Parser) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+
+	consumed := 0
+	defer func() {
+		p.buf = append(p.buf[:0], p.buf[consumed:]...)
+	}()
+
+	for {
+		for len(p.stack) > 0 {
+			top := p.stack[len(p.stack)-1]
+			if top.end < 0 || p.pos < top.end {
+				break
+			}
+			p.stack = p.stack[:len(p.stack)-1]
+		}
+
+		rest := p.buf[consumed:]
+		id, size, n, err := ReadElementHeader(rest)
+		if err != nil {
+			return len(b), err
+		}
+		if n == 0 {
+			return len(b), nil
+		}
+
+		for len(p.stack) > 0 {
+			top := p.stack[len(p.stack)-1]
+			if top.end >= 0 || isChild(top.id, id) {
+				break
+			}
+			p.stack = p.stack[:len(p.stack)-1]
+		}
+
+		el := Element{
+			ID:        id,
+			Size:      size,
+			Level:     len(p.stack),
+			Offset:    p.pos,
+			HeaderLen: n,
+		}
+
+		if p.isMaster(id) {
+			el.Master = true
+			end := int64(-1)
+			if size >= 0 {
+				end = p.pos + int64(n) + size
+			}
+			p.stack = append(p.stack, openMaster{id: id, end: end})
+			consumed += n
+			p.pos += int64(n)
+			if err := p.handler(&el); err != nil {
+				return len(b), err
+			}
+			continue
+		}
+
+		if size < 0 {
+			return len(b), ErrInvalid
+		}
+		if p.MaxElementSize > 0 && size > p.MaxElementSize {
+			return len(b), ErrElementTooLarge
+		}
+		if int64(len(rest)-n) < size {
+			return len(b), nil
+		}
+
+		el.Data = rest[n : int64(n)+size]
+		consumed += n + int(size)
+		p.pos += int64(n) + size
+		if err := p.handler(&el); err != nil {
+			return len(b), err
+		}
+	}
+}
+
+func (p *Parser) isMaster(id uint32) bool {
+	switch id {
+	case IDSegment:
+		return len(p.stack) == 0
+	case IDCluster:
+		return len(p.stack) == 1 && p.stack[0].id == IDSegment
+	default:
+		return false
+	}
+}
+
+func isLevel1(id uint32) bool {
+	switch id {
+	case IDSeekHead, IDInfo, IDTracks, IDCluster, IDCues, IDTags, IDChapters, IDAttachments:
+		return true
+	default:
+		return false
+	}
+}
+
+// isChild reports whether id may appear inside an unknown-size parent.
+func isChild(parent, id uint32) bool {
+	if id == IDEBML || id == IDSegment {
+		return false
+	}
+	if parent == IDCluster {
+		return !isLevel1(id)
+	}
+	return true
+}
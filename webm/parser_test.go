@@ -0,0 +1,179 @@
+package webm
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+var names = map[uint32]string{
+	IDEBML:        "EBML",
+	IDSegment:     "Segment",
+	IDInfo:        "Info",
+	IDTracks:      "Tracks",
+	IDCluster:     "Cluster",
+	IDCues:        "Cues",
+	IDTimecode:    "Timecode",
+	IDSimpleBlock: "SimpleBlock",
+}
+
+func header() []byte {
+	return AppendElement(nil, IDEBML, AppendElement(nil, 0x4282, []byte("webm")))
+}
+
+func info() []byte {
+	return AppendElement(nil, IDInfo, AppendUint(nil, IDTimecodeScale, DefaultTimecodeScale))
+}
+
+func tracks() []byte {
+	entry := AppendUint(nil, IDTrackNumber, 1)
+	entry = AppendUint(entry, IDTrackType, TrackTypeVideo)
+	entry = AppendElement(entry, IDCodecID, []byte("V_VP8"))
+	return AppendElement(nil, IDTracks, AppendElement(nil, IDTrackEntry, entry))
+}
+
+// cluster is the payload of a cluster with a keyframe at its start.
+func cluster(timecode uint64) []byte {
+	b := AppendUint(nil, IDTimecode, timecode)
+	return AppendElement(b, IDSimpleBlock, []byte{0x81, 0, 0, 0x80, 'k'})
+}
+
+// liveStream is a stream as MediaRecorder writes it: a Segment and Clusters
+// of unknown size.
+func liveStream(timecodes ...uint64) []byte {
+	b := AppendMasterStart(header(), IDSegment)
+	b = append(append(b, info()...), tracks()...)
+	for _, timecode := range timecodes {
+		b = append(AppendMasterStart(b, IDCluster), cluster(timecode)...)
+	}
+	return b
+}
+
+func knownStream() []byte {
+	body := append(info(), tracks()...)
+	body = AppendElement(body, IDCluster, cluster(0))
+	body = AppendElement(body, IDCluster, cluster(1000))
+	return AppendElement(header(), IDSegment, body)
+}
+
+// parse returns the elements found in stream fed in chunks of size, as
+// name@level with a + for the masters.
+func parse(stream []byte, size int) ([]string, *Parser, error) {
+	var found []string
+	var last int64 = -1
+	p := NewParser(func(el *Element) error {
+		if el.Offset <= last {
+			return fmt.Errorf("element at %d after %d", el.Offset, last)
+		}
+		last = el.Offset
+		name := fmt.Sprintf("%s@%d", names[el.ID], el.Level)
+		if el.Master {
+			name += "+"
+		}
+		found = append(found, name)
+		return nil
+	})
+
+	for len(stream) > 0 {
+		n := size
+		if n > len(stream) {
+			n = len(stream)
+		}
+		if _, err := p.Write(stream[:n]); err != nil {
+			return found, p, err
+		}
+		stream = stream[n:]
+	}
+	return found, p, nil
+}
+
+func TestParser(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		stream []byte
+		want   []string
+	}{
+		{
+			name:   "known size",
+			stream: knownStream(),
+			want: []string{"EBML@0", "Segment@0+", "Info@1", "Tracks@1",
+				"Cluster@1+", "Timecode@2", "SimpleBlock@2",
+				"Cluster@1+", "Timecode@2", "SimpleBlock@2"},
+		},
+		{
+			name:   "unknown size clusters",
+			stream: AppendElement(liveStream(0, 1000), IDCues, nil),
+			want: []string{"EBML@0", "Segment@0+", "Info@1", "Tracks@1",
+				"Cluster@1+", "Timecode@2", "SimpleBlock@2",
+				"Cluster@1+", "Timecode@2", "SimpleBlock@2", "Cues@1"},
+		},
+		{
+			name:   "restarted stream",
+			stream: append(liveStream(0), liveStream(0)...),
+			want: []string{"EBML@0", "Segment@0+", "Info@1", "Tracks@1",
+				"Cluster@1+", "Timecode@2", "SimpleBlock@2",
+				"EBML@0", "Segment@0+", "Info@1", "Tracks@1",
+				"Cluster@1+", "Timecode@2", "SimpleBlock@2"},
+		},
+	} {
+		for _, size := range []int{len(tt.stream), 1, 7} {
+			t.Run(fmt.Sprintf("%s/%d", tt.name, size), func(t *testing.T) {
+				found, p, err := parse(tt.stream, size)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(found, tt.want) {
+					t.Errorf("found %v\nwant %v", found, tt.want)
+				}
+				if p.Buffered() != 0 || p.Offset() != int64(len(tt.stream)) {
+					t.Errorf("parsed up to %d with %d buffered, want %d", p.Offset(), p.Buffered(), len(tt.stream))
+				}
+			})
+		}
+	}
+}
+
+func TestParserErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		stream []byte
+		max    int64
+		want   error
+	}{
+		{
+			name:   "unknown size block",
+			stream: AppendMasterStart(AppendMasterStart(header(), IDSegment), IDSimpleBlock),
+			want:   ErrInvalid,
+		},
+		{
+			name:   "element too large",
+			stream: AppendElement(header(), IDTracks, make([]byte, 100)),
+			max:    64,
+			want:   ErrElementTooLarge,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser(func(*Element) error { return nil })
+			if tt.max > 0 {
+				p.MaxElementSize = tt.max
+			}
+			if _, err := p.Write(tt.stream); err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParserWaitsForElement(t *testing.T) {
+	stream := liveStream(0)
+	found, p, err := parse(stream[:len(stream)-2], len(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := found[len(found)-1]; last != "Timecode@2" {
+		t.Errorf("last element %s, want the block held back", last)
+	}
+	if p.Buffered() == 0 {
+		t.Error("nothing buffered for the incomplete block")
+	}
+}
@@ -0,0 +1,59 @@
+package webm
+
+// Track types of a TrackEntry.
+const (
+	TrackTypeVideo = 1
+	TrackTypeAudio = 2
+)
+
+// Track is the part of a TrackEntry the pipeline needs.
+type Track struct {
+	Number  uint64
+	Type    uint64
+	CodecID string
+}
+
+// ParseTracks decodes the entries of a Tracks payload.
+func ParseTracks(data []byte) ([]Track, error) {
+	entries, err := Children(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var tracks []Track
+	for _, entry := range entries {
+		if entry.ID != IDTrackEntry {
+			continue
+		}
+
+		children, err := Children(entry.Data)
+		if err != nil {
+			return tracks, err
+		}
+
+		var track Track
+		for _, child := range children {
+			switch child.ID {
+			case IDTrackNumber:
+				track.Number = ReadUint(child.Data)
+			case IDTrackType:
+				track.Type = ReadUint(child.Data)
+			case IDCodecID:
+				track.CodecID = string(child.Data)
+			}
+		}
+		tracks = append(tracks, track)
+	}
+
+	return tracks, nil
+}
+
+// FindTrack returns the first track of the given type.
+func FindTrack(tracks []Track, trackType uint64) (Track, bool) {
+	for _, track := range tracks {
+		if track.Type == trackType {
+			return track, true
+		}
+	}
+	return Track{}, false
+}
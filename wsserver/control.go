@@ -0,0 +1,266 @@
+package wsserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Actions understood by the extension.
+const (
+	ActionStart      = "start"
+	ActionStop       = "stop"
+	ActionPause      = "pause"
+	ActionResume     = "resume"
+	ActionSetBitrate = "set-bitrate"
+)
+
+// Types of the text messages exchanged on the ingest websocket.
+const (
+	MessageCommand = "command"
+	MessageAck     = "ack"
+	MessageStats   = "stats"
+)
+
+const commandTimeout = 10 * time.Second
+
+var (
+	ErrNotConnected = errors.New("extension is not connected")
+	ErrAckTimeout   = errors.New("extension did not acknowledge the command")
+)
+
+var commandId int64
+
+var (
+	commandHandlersLock sync.Mutex
+	commandHandlers     = map[string]func(action string) error{}
+)
+
+// CaptureOptions are the tab capture and MediaRecorder settings of a task.
+type CaptureOptions struct {
+	VideoBitRate int `json:"videoBitsPerSecond,omitempty"`
+	AudioBitRate int `json:"audioBitsPerSecond,omitempty"`
+	FrameRate    int `json:"frameRate,omitempty"`
+	Width        int `json:"width,omitempty"`
+	Height       int `json:"height,omitempty"`
+}
+
+// Command is sent from Go to the extension as a JSON text message.
+type Command struct {
+	Type   string `json:"type"`
+	Id     int64  `json:"id"`
+	Action string `json:"action"`
+	CaptureOptions
+}
+
+// RecorderStats is reported periodically by the extension.
+type RecorderStats struct {
+	State        string    `json:"state"`
+	MimeType     string    `json:"mimeType"`
+	VideoBitRate int       `json:"videoBitsPerSecond"`
+	AudioBitRate int       `json:"audioBitsPerSecond"`
+	Chunks       int64     `json:"chunks"`
+	Bytes        int64     `json:"bytes"`
+	UpdateTime   time.Time `json:"-"`
+}
+
+// Reply is a JSON text message sent by the extension, either the ack of a
+// command or a stats report.
+type Reply struct {
+	Type  string `json:"type"`
+	Id    int64  `json:"id"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error"`
+	RecorderStats
+}
+
+var (
+	captureOptionsLock sync.Mutex
+	captureOptions     = map[string]CaptureOptions{}
+)
+
+// SetCaptureOptions registers the settings sent with the start command when
+// the extension of the task connects.
+func SetCaptureOptions(taskName string, opts CaptureOptions) {
+	captureOptionsLock.Lock()
+	defer captureOptionsLock.Unlock()
+
+	captureOptions[taskName] = opts
+}
+
+// ClearCaptureOptions removes the settings of the task once it is done.
+func ClearCaptureOptions(taskName string) {
+	captureOptionsLock.Lock()
+	defer captureOptionsLock.Unlock()
+
+	delete(captureOptions, taskName)
+}
+
+func getCaptureOptions(taskName string) CaptureOptions {
+	captureOptionsLock.Lock()
+	defer captureOptionsLock.Unlock()
+
+	if opts, ok := captureOptions[taskName]; ok {
+		return opts
+	}
+
+	return CaptureOptions{
+		VideoBitRate: *conf.ForceVideoBitRate * 1000,
+		AudioBitRate: *conf.ForceAudioBitRate * 1000,
+		FrameRate:    *conf.ForceFrameRate,
+		Width:        *conf.VideoWidth,
+		Height:       *conf.VideoHeight,
+	}
+}
+
+func getRecording(taskName string) *recording {
+	recordingsLock.Lock()
+	defer recordingsLock.Unlock()
+
+	return recordings[taskName]
+}
+
+// SetCommandHandler registers the function running the actions of a task
+// recorded in this process, e.g. by the screencast encoder, which has no
+// extension to send them to. nil removes it.
+func SetCommandHandler(taskName string, handler func(action string) error) {
+	commandHandlersLock.Lock()
+	defer commandHandlersLock.Unlock()
+
+	if handler == nil {
+		delete(commandHandlers, taskName)
+		return
+	}
+	commandHandlers[taskName] = handler
+}
+
+func getCommandHandler(taskName string) func(string) error {
+	commandHandlersLock.Lock()
+	defer commandHandlersLock.Unlock()
+
+	return commandHandlers[taskName]
+}
+
+// SendCommand sends an action to the extension of the task and waits for
+// its ack, or runs it by the command handler of the task.
+func SendCommand(taskName, action string, opts CaptureOptions) error {
+	if handler := getCommandHandler(taskName); handler != nil {
+		return handler(action)
+	}
+
+	rec := getRecording(taskName)
+	if rec == nil {
+		return ErrNotConnected
+	}
+
+	return rec.sendCommand(action, opts)
+}
+
+// StartCapture (re)starts the extension recorder of the task with its
+// registered capture options.
+func StartCapture(taskName string) error {
+	return SendCommand(taskName, ActionStart, getCaptureOptions(taskName))
+}
+
+// GetRecorderStats returns the last stats reported by the extension of the task.
+func GetRecorderStats(taskName string) (*RecorderStats, bool) {
+	rec := getRecording(taskName)
+	if rec == nil {
+		return nil, false
+	}
+
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	if rec.stats == nil {
+		return nil, false
+	}
+	stats := *rec.stats
+	return &stats, true
+}
+
+func (rec *recording) sendCommand(action string, opts CaptureOptions) error {
+	cmd := Command{
+		Type:           MessageCommand,
+		Id:             atomic.AddInt64(&commandId, 1),
+		Action:         action,
+		CaptureOptions: opts,
+	}
+
+	data, err := json.Marshal(&cmd)
+	if err != nil {
+		return err
+	}
+
+	chAck := make(chan *Reply, 1)
+	rec.lock.Lock()
+	conn := rec.conn
+	if conn == nil {
+		rec.lock.Unlock()
+		return ErrNotConnected
+	}
+	rec.pending[cmd.Id] = chAck
+	rec.lock.Unlock()
+
+	defer func() {
+		rec.lock.Lock()
+		delete(rec.pending, cmd.Id)
+		rec.lock.Unlock()
+	}()
+
+	rec.writeLock.Lock()
+	conn.SetWriteDeadline(time.Now().Add(commandTimeout))
+	err = conn.WriteMessage(websocket.TextMessage, data)
+	rec.writeLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	logrus.Debugf("send command %s (%d). %s", action, cmd.Id, rec.Description())
+
+	select {
+	case reply := <-chAck:
+		if !reply.Ok {
+			return fmt.Errorf("extension rejected %s: %s", action, reply.Error)
+		}
+		return nil
+	case <-time.After(commandTimeout):
+		return ErrAckTimeout
+	}
+}
+
+// onTextMessage handles a JSON message sent by the extension.
+func (rec *recording) onTextMessage(message []byte) {
+	var reply Reply
+	if err := json.Unmarshal(message, &reply); err != nil {
+		logrus.WithError(err).Warnf("unmarshal extension message failed. %s", rec.Description())
+		return
+	}
+
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	switch reply.Type {
+	case MessageAck:
+		// answered once, a duplicate or late ack finds no entry
+		if chAck, ok := rec.pending[reply.Id]; ok {
+			delete(rec.pending, reply.Id)
+			select {
+			case chAck <- &reply:
+			default:
+			}
+		}
+	case MessageStats:
+		stats := reply.RecorderStats
+		stats.UpdateTime = time.Now()
+		rec.stats = &stats
+		logrus.Debugf("recorder stats: %+v. %s", stats, rec.Description())
+	default:
+		logrus.Warnf("unknown extension message type: %s. %s", reply.Type, rec.Description())
+	}
+}
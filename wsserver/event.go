@@ -0,0 +1,111 @@
+package wsserver
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of the events sent to the task of a recording.
+const (
+	EventRecordStarted   = "record-started"
+	EventRecordResumed   = "record-resumed"
+	EventRecordFinished  = "record-finished"
+	EventSegmentFinished = "segment-finished"
+	EventUploaded        = "uploaded"
+	EventWriteError      = "write-error"
+	EventSilence         = "silence"
+	EventSoundRestored   = "sound-restored"
+	EventQuotaExceeded   = "quota-exceeded"
+	EventQuotaRecovered  = "quota-recovered"
+	EventOOMKilled       = "oom-killed"
+	EventBrowserExited   = "browser-exited"
+)
+
+// Event tells the task what happened to its recording.
+type Event struct {
+	TaskName  string
+	Type      string
+	Path      string
+	Segment   int
+	Location  string
+	Err       error
+	DiskFull  bool
+	SilentFor int
+	Reason    string
+	Time      time.Time
+}
+
+var (
+	eventHandlersLock sync.Mutex
+	eventHandlers     = map[string]func(*Event){}
+	eventQueues       = map[string]*eventQueue{}
+)
+
+// eventQueue holds the events of a task not yet passed to its handler. They
+// are delivered one at a time in the order they were emitted, by a goroutine
+// running while the queue is not empty.
+type eventQueue struct {
+	events []queuedEvent
+}
+
+type queuedEvent struct {
+	ev      *Event
+	handler func(*Event)
+}
+
+// SetEventHandler registers the function called with the recording events
+// of the task, nil removes it.
+func SetEventHandler(taskName string, handler func(*Event)) {
+	eventHandlersLock.Lock()
+	defer eventHandlersLock.Unlock()
+
+	if handler == nil {
+		delete(eventHandlers, taskName)
+		return
+	}
+	eventHandlers[taskName] = handler
+}
+
+// Emit sends an event to the task, for the parts of the pipeline outside the
+// ingest server.
+func Emit(ev *Event) {
+	emit(ev)
+}
+
+func emit(ev *Event) {
+	ev.Time = time.Now()
+
+	eventHandlersLock.Lock()
+	defer eventHandlersLock.Unlock()
+
+	handler := eventHandlers[ev.TaskName]
+	if handler == nil {
+		return
+	}
+
+	q, running := eventQueues[ev.TaskName]
+	if !running {
+		q = &eventQueue{}
+		eventQueues[ev.TaskName] = q
+	}
+	q.events = append(q.events, queuedEvent{ev: ev, handler: handler})
+	if !running {
+		go deliverEvents(ev.TaskName, q)
+	}
+}
+
+func deliverEvents(taskName string, q *eventQueue) {
+	for {
+		eventHandlersLock.Lock()
+		if len(q.events) == 0 {
+			delete(eventQueues, taskName)
+			eventHandlersLock.Unlock()
+			return
+		}
+		next := q.events[0]
+		q.events = q.events[1:]
+		eventHandlersLock.Unlock()
+
+		next.handler(next.ev)
+	}
+}
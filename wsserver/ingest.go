@@ -0,0 +1,115 @@
+package wsserver
+
+import (
+	"sync"
+	"time"
+)
+
+const bitRateWindow = 5 * time.Second
+
+// IngestStats is the traffic accounting of the connection feeding a recording.
+type IngestStats struct {
+	BytesReceived int64
+	BytesWritten  int64
+	Messages      int64
+	BitRate       int // kb/s over the last few seconds
+	Throttled     time.Duration
+	ConnectTime   time.Time
+}
+
+// ingestMeter counts the bytes of one connection and, with a configured
+// limit, delays the next read so a fast sender is held back by TCP flow
+// control instead of growing our buffers.
+type ingestMeter struct {
+	lock sync.Mutex
+
+	stats IngestStats
+	limit int64 // bytes per second, 0 is unlimited
+
+	windowStart time.Time
+	windowBytes int64
+
+	throttleStart time.Time
+	throttleBytes int64
+}
+
+func newIngestMeter() *ingestMeter {
+	now := time.Now()
+	return &ingestMeter{
+		stats:         IngestStats{ConnectTime: now},
+		limit:         int64(*conf.MaxIngestBitRate) * 1000 / 8,
+		windowStart:   now,
+		throttleStart: now,
+	}
+}
+
+// received accounts a message and returns how long to wait before reading
+// the next one.
+func (m *ingestMeter) received(n int) time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	m.stats.BytesReceived += int64(n)
+	m.stats.Messages++
+
+	m.windowBytes += int64(n)
+	if elapsed := now.Sub(m.windowStart); elapsed >= bitRateWindow {
+		m.stats.BitRate = int(m.windowBytes * 8 * int64(time.Second) / int64(elapsed) / 1000)
+		m.windowStart = now
+		m.windowBytes = 0
+	}
+
+	if m.limit <= 0 {
+		return 0
+	}
+
+	m.throttleBytes += int64(n)
+	expected := time.Duration(m.throttleBytes * int64(time.Second) / m.limit)
+	elapsed := now.Sub(m.throttleStart)
+	if expected <= elapsed {
+		if elapsed > bitRateWindow {
+			// don't let an idle period build up credit for a burst
+			m.throttleStart = now
+			m.throttleBytes = 0
+		}
+		return 0
+	}
+
+	delay := expected - elapsed
+	m.stats.Throttled += delay
+	return delay
+}
+
+func (m *ingestMeter) written(n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.stats.BytesWritten += int64(n)
+}
+
+func (m *ingestMeter) snapshot() IngestStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.stats
+}
+
+// GetIngestStats returns the traffic of the connection currently feeding the
+// recording of the task.
+func GetIngestStats(taskName string) (*IngestStats, bool) {
+	rec := getRecording(taskName)
+	if rec == nil {
+		return nil, false
+	}
+
+	rec.lock.Lock()
+	meter := rec.meter
+	rec.lock.Unlock()
+
+	if meter == nil {
+		return nil, false
+	}
+	stats := meter.snapshot()
+	return &stats, true
+}
@@ -0,0 +1,210 @@
+package wsserver
+
+import (
+	"chrome_render/catalog"
+	"chrome_render/storage"
+	"chrome_render/webm"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const journalExt = ".journal"
+
+// journal is kept next to a segment file while it is written. A journal left
+// behind on startup means the process died before the segment was closed.
+type journal struct {
+	TaskName  string    `json:"taskName"`
+	Url       string    `json:"url,omitempty"`
+	SessionId string    `json:"sessionId"`
+	Segment   int       `json:"segment"`
+	StartTime time.Time `json:"startTime"`
+}
+
+func writeJournal(rec *recording) error {
+	data, err := json.Marshal(&journal{
+		TaskName:  rec.taskName,
+		Url:       getTaskUrl(rec.taskName),
+		SessionId: rec.sessionId,
+		Segment:   rec.segment,
+		StartTime: rec.segmentStart,
+	})
+	if err != nil {
+		return err
+	}
+
+	fd, err := os.Create(rec.path + journalExt)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(data); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+func removeJournal(path string) {
+	if err := os.Remove(path + journalExt); err != nil && !os.IsNotExist(err) {
+		logrus.WithError(err).Errorf("remove recording journal %s failed", path+journalExt)
+	}
+}
+
+// Recover repairs the segments left unfinished by a previous run. Each one is
+// trimmed to its last complete cluster, rewritten with a duration and cues
+// and registered in the catalog as recovered.
+func Recover() {
+	infos, err := ioutil.ReadDir(*conf.LocalVideoPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.WithError(err).Errorln("scan for unfinished recordings failed")
+		}
+		return
+	}
+
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), journalExt) {
+			continue
+		}
+
+		path := filepath.Join(*conf.LocalVideoPath, strings.TrimSuffix(info.Name(), journalExt))
+		if err := recoverSegment(path); err != nil {
+			logrus.WithError(err).Errorf("recover recording %s failed", path)
+			continue
+		}
+		removeJournal(path)
+	}
+}
+
+// ResumeUploads submits again the segments whose upload to the record domain
+// was left unfinished, they continue from the offset the server has.
+func ResumeUploads() {
+	paths, err := storage.PendingUploads(*conf.LocalVideoPath)
+	if err != nil {
+		logrus.WithError(err).Errorln("scan for unfinished uploads failed")
+		return
+	}
+
+	for _, path := range paths {
+		entry, ok := catalog.Get(segmentId(path))
+		if !ok {
+			logrus.Warnf("unfinished upload of %s has no recording in the catalog", path)
+			continue
+		}
+		logrus.Printf("resume upload of recording %s. task name: %s", entry.Id, entry.TaskName)
+		submitSegment(entry)
+	}
+}
+
+func recoverSegment(path string) error {
+	data, err := ioutil.ReadFile(path + journalExt)
+	if err != nil {
+		return err
+	}
+	var j journal
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	id := segmentId(path)
+	if _, ok := catalog.Get(id); ok {
+		// died after the segment was closed
+		return nil
+	}
+
+	src, err := os.Open(path)
+	if os.IsNotExist(err) {
+		logrus.Warnf("unfinished recording %s is gone", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	idx, err := webm.Scan(src)
+	if err != nil {
+		return err
+	}
+	idx.Trim()
+	if len(idx.Clusters) == 0 {
+		logrus.Warnf("unfinished recording %s has no complete cluster, removed", path)
+		src.Close()
+		return os.Remove(path)
+	}
+
+	tmpPath := path + ".repair"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	counter := &countWriter{}
+	err = webm.WriteFinal(io.MultiWriter(dst, hash, counter), src, idx)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	var codecs []string
+	if children, err := webm.Children(idx.Tracks); err == nil && len(children) == 1 {
+		if tracks, err := webm.ParseTracks(children[0].Data); err == nil {
+			for _, track := range tracks {
+				codecs = append(codecs, track.CodecID)
+			}
+		}
+	}
+
+	duration := time.Duration(idx.Duration()) * time.Duration(idx.TimecodeScale)
+	logrus.Infof("recovered recording %s, duration: %s, dropped %d bytes", path, duration, stat.Size()-idx.End)
+	publishSegment(&catalog.Recording{
+		Id:        id,
+		TaskName:  j.TaskName,
+		Url:       j.Url,
+		SessionId: j.SessionId,
+		Segment:   j.Segment,
+		StartTime: j.StartTime,
+		EndTime:   j.StartTime.Add(duration),
+		Duration:  duration.Seconds(),
+		Size:      counter.n,
+		Codecs:    codecs,
+		Sha256:    hex.EncodeToString(hash.Sum(nil)),
+		Path:      path,
+		Location:  path,
+		State:     catalog.StateRecovered,
+	})
+	return nil
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	w.n += int64(len(b))
+	return len(b), nil
+}
@@ -0,0 +1,106 @@
+package wsserver
+
+import (
+	"bytes"
+	"chrome_render/catalog"
+	"chrome_render/webm"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecoverTruncatedSegment(t *testing.T) {
+	setup(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	rec := &recording{
+		taskName:     "crashed",
+		sessionId:    "session-1",
+		segmentStart: start,
+		path:         filepath.Join(*conf.LocalVideoPath, "crashed_1-session-1.webm"),
+	}
+	if err := writeJournal(rec); err != nil {
+		t.Fatal(err)
+	}
+	// the process died in the middle of the cluster at 3000
+	data := liveStream(0, 1000, 2000, 3000)
+	if err := ioutil.WriteFile(rec.path, data[:len(data)-3], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	Recover()
+
+	if _, err := os.Stat(rec.path + journalExt); !os.IsNotExist(err) {
+		t.Errorf("journal left after recovery: %v", err)
+	}
+	entry, ok := catalog.Get(segmentId(rec.path))
+	if !ok {
+		t.Fatal("recovered segment not in the catalog")
+	}
+	if entry.State != catalog.StateRecovered || entry.TaskName != "crashed" || !entry.StartTime.Equal(start) {
+		t.Errorf("catalog entry %+v", entry)
+	}
+	if entry.Duration != 2.5 {
+		t.Errorf("duration %v, want 2.5s up to the last complete cluster", entry.Duration)
+	}
+
+	recovered, err := ioutil.ReadFile(rec.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(recovered)) != entry.Size {
+		t.Errorf("catalog size %d, file size %d", entry.Size, len(recovered))
+	}
+	idx, err := webm.Scan(bytes.NewReader(recovered))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.Truncated || len(idx.Clusters) != 3 {
+		t.Errorf("recovered file has %d clusters, truncated %v", len(idx.Clusters), idx.Truncated)
+	}
+
+	// positions of the cues are relative to the segment data
+	var segmentStart int64
+	clusters := map[int64]bool{}
+	var cues []int64
+	p := webm.NewParser(func(el *webm.Element) error {
+		switch el.ID {
+		case webm.IDSegment:
+			segmentStart = el.Offset + int64(el.HeaderLen)
+		case webm.IDCluster:
+			clusters[el.Offset-segmentStart] = true
+		case webm.IDCues:
+			points, err := webm.Children(el.Data)
+			if err != nil {
+				return err
+			}
+			for _, point := range points {
+				children, _ := webm.Children(point.Data)
+				for _, child := range children {
+					if child.ID != webm.IDCueTrackPositions {
+						continue
+					}
+					positions, _ := webm.Children(child.Data)
+					for _, position := range positions {
+						if position.ID == webm.IDCueClusterPosition {
+							cues = append(cues, int64(webm.ReadUint(position.Data)))
+						}
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if _, err := p.Write(recovered); err != nil {
+		t.Fatal(err)
+	}
+	if len(cues) != 3 {
+		t.Fatalf("cues at %v, want one per keyframe cluster", cues)
+	}
+	for _, position := range cues {
+		if !clusters[position] {
+			t.Errorf("cue points at %d, no cluster there", position)
+		}
+	}
+}
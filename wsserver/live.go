@@ -0,0 +1,265 @@
+package wsserver
+
+import (
+	"chrome_render/webm"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	viewerQueueSize    = 256
+	viewerWriteTimeout = 10 * time.Second
+)
+
+// liveHub relays the webm written to a recording to live viewers. The bytes
+// written before the first cluster are kept as the init segment; a viewer
+// gets it first and then joins at the next cluster starting with a video
+// keyframe, which is what an MSE SourceBuffer needs to attach mid-stream.
+// A restarted recorder sends a new header, which replaces the init segment.
+type liveHub struct {
+	lock sync.Mutex
+
+	init       []byte
+	initDone   bool
+	videoTrack uint64
+	viewers    map[*viewer]struct{}
+	closed     bool
+}
+
+type viewer struct {
+	conn    *websocket.Conn
+	ch      chan []byte
+	waiting bool
+	pending [][]byte
+	started bool
+}
+
+func newLiveHub() *liveHub {
+	return &liveHub{
+		viewers: map[*viewer]struct{}{},
+	}
+}
+
+// element is called with every element written to the recording.
+func (h *liveHub) element(id uint32, b []byte) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !h.initDone {
+		if id != webm.IDCluster {
+			h.init = append(h.init, b...)
+			if id == webm.IDTracks {
+				h.parseTracks(b)
+			}
+			return
+		}
+
+		h.initDone = true
+		for v := range h.viewers {
+			v.started = true
+			v.send(h.init)
+		}
+	}
+
+	if len(h.viewers) == 0 {
+		return
+	}
+
+	keyframe := false
+	video := false
+	if id == webm.IDSimpleBlock {
+		if _, _, n, err := webm.ReadElementHeader(b); err == nil && n > 0 {
+			if block, err := webm.ParseBlock(b[n:]); err == nil {
+				video = h.videoTrack == 0 || block.Track == h.videoTrack
+				keyframe = block.Keyframe()
+			}
+		}
+	}
+
+	for v := range h.viewers {
+		if !v.waiting {
+			v.send(b)
+			continue
+		}
+
+		switch {
+		case id == webm.IDCluster:
+			v.pending = append(v.pending[:0], b)
+		case len(v.pending) == 0:
+			// wait for the start of the next cluster
+		case video && keyframe:
+			// an overflow while flushing drops the cluster, send left the
+			// viewer waiting for the next one
+			if v.flush(b) {
+				v.pending = nil
+				v.waiting = false
+			}
+		case video || id == webm.IDBlockGroup:
+			// the cluster doesn't start with a keyframe
+			v.pending = nil
+		default:
+			v.pending = append(v.pending, b)
+		}
+	}
+}
+
+// restart drops the init segment when the recorder starts a new stream. The
+// header that follows is sent to the viewers as the new init segment, then
+// they join again at a keyframe cluster of the new stream.
+func (h *liveHub) restart() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.init = nil
+	h.initDone = false
+	h.videoTrack = 0
+	for v := range h.viewers {
+		v.waiting = true
+		v.pending = nil
+	}
+}
+
+func (h *liveHub) parseTracks(b []byte) {
+	_, _, n, err := webm.ReadElementHeader(b)
+	if err != nil || n == 0 {
+		return
+	}
+
+	tracks, err := webm.ParseTracks(b[n:])
+	if err != nil {
+		logrus.WithError(err).Warnln("parse tracks for live viewers failed")
+	}
+	if track, ok := webm.FindTrack(tracks, webm.TrackTypeVideo); ok {
+		h.videoTrack = track.Number
+	}
+}
+
+// add registers a viewer, false once the recording is finished.
+func (h *liveHub) add(v *viewer) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.closed {
+		return false
+	}
+	v.waiting = true
+	if h.initDone {
+		v.started = true
+		v.send(h.init)
+	}
+	h.viewers[v] = struct{}{}
+	return true
+}
+
+func (h *liveHub) remove(v *viewer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, ok := h.viewers[v]; ok {
+		delete(h.viewers, v)
+		close(v.ch)
+	}
+}
+
+// closeAll disconnects every viewer when the recording is finished.
+func (h *liveHub) closeAll() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.closed = true
+	for v := range h.viewers {
+		delete(h.viewers, v)
+		close(v.ch)
+	}
+}
+
+// send queues b for the viewer. A viewer too slow to keep up skips ahead to
+// the next keyframe cluster instead of holding back the recording.
+func (v *viewer) send(b []byte) bool {
+	if !v.started {
+		return false
+	}
+
+	select {
+	case v.ch <- b:
+		return true
+	default:
+		v.waiting = true
+		v.pending = nil
+		return false
+	}
+}
+
+// flush sends the held start of the cluster and b, stopping at the first
+// element the viewer has no room for.
+func (v *viewer) flush(b []byte) bool {
+	for _, p := range v.pending {
+		if !v.send(p) {
+			return false
+		}
+	}
+	return v.send(b)
+}
+
+func (v *viewer) writeLoop() {
+	for b := range v.ch {
+		v.conn.SetWriteDeadline(time.Now().Add(viewerWriteTimeout))
+		if err := v.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+			logrus.WithError(err).Debugln("write to live viewer failed")
+			v.conn.Close()
+			for range v.ch {
+			}
+			return
+		}
+	}
+
+	v.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "recording finished"),
+		time.Now().Add(time.Second))
+	v.conn.Close()
+}
+
+// live streams the recording of the task named by the task query parameter
+// to a websocket viewer as binary webm messages.
+func live(w http.ResponseWriter, r *http.Request) {
+	taskName := r.URL.Query().Get("task")
+	rec := getRecording(taskName)
+	if rec == nil {
+		http.Error(w, "task is not recording", http.StatusNotFound)
+		return
+	}
+
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logrus.WithError(err).Errorln("upgrade failed")
+		return
+	}
+
+	v := &viewer{
+		conn: c,
+		ch:   make(chan []byte, viewerQueueSize),
+	}
+	if !rec.live.add(v) {
+		c.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "recording finished"),
+			time.Now().Add(time.Second))
+		c.Close()
+		return
+	}
+	logrus.Printf("live viewer %s connected. %s", r.RemoteAddr, rec.Description())
+
+	go v.writeLoop()
+
+	// viewers only send control frames, read until they go away
+	for {
+		if _, _, err := c.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	rec.live.remove(v)
+	logrus.Printf("live viewer %s disconnected. %s", r.RemoteAddr, rec.Description())
+}
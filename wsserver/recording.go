@@ -0,0 +1,712 @@
+package wsserver
+
+import (
+	"bufio"
+	"chrome_render/catalog"
+	"chrome_render/config"
+	"chrome_render/hls"
+	"chrome_render/storage"
+	"chrome_render/thumbnail"
+	"chrome_render/webm"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"hash"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var conf = config.GetConfig()
+
+var errSuperseded = errors.New("connection superseded by a reconnect")
+
+var (
+	recordingsLock sync.Mutex
+	recordings     = map[string]*recording{}
+
+	taskUrlsLock sync.Mutex
+	taskUrls     = map[string]string{}
+)
+
+// SetTaskUrl registers the page url of the task for the recording catalog,
+// an empty url removes it.
+func SetTaskUrl(taskName, url string) {
+	taskUrlsLock.Lock()
+	defer taskUrlsLock.Unlock()
+
+	if url == "" {
+		delete(taskUrls, taskName)
+		return
+	}
+	taskUrls[taskName] = url
+}
+
+func getTaskUrl(taskName string) string {
+	taskUrlsLock.Lock()
+	defer taskUrlsLock.Unlock()
+
+	return taskUrls[taskName]
+}
+
+// recording is the webm written for one extension session. It outlives the
+// websocket that feeds it, so an extension reconnecting with the same task
+// and session id keeps appending clusters to the same file instead of
+// starting a new one. With a segment duration the recording is rotated into
+// several files, each starting with the same header.
+type recording struct {
+	lock sync.Mutex
+
+	taskName     string
+	sessionId    string
+	path         string
+	fd           *os.File
+	writer       *bufio.Writer
+	lastSync     time.Time
+	startTime    time.Time
+	segment      int
+	segmentStart time.Time
+	segmentBase  int64
+	segmentSize  int64
+	segmentHash  hash.Hash
+	rebase       bool
+	header       []byte
+	codecs       []string
+	err          error
+
+	conn       *websocket.Conn
+	meter      *ingestMeter
+	writeLock  sync.Mutex
+	closeTimer *time.Timer
+	closed     bool
+
+	pending map[int64]chan *Reply
+	stats   *RecorderStats
+	live    *liveHub
+	audio   *audioMeter
+	hls     *hls.Writer
+
+	headerWritten bool
+	timecodeScale uint64
+	lastTimecode  int64
+	lastWriteTime time.Time
+}
+
+// stream is the parsing state of one websocket connection. Every connection
+// carries a complete webm stream starting with its own EBML header, and a
+// restarted recorder sends another one on the same connection.
+type stream struct {
+	rec       *recording
+	conn      *websocket.Conn
+	parser    *webm.Parser
+	meter     *ingestMeter
+	resumed   bool
+	hasOffset bool
+	offset    int64
+	cluster   int64
+	scale     uint64
+}
+
+func (rec *recording) Description() string {
+	return fmt.Sprintf("task name: %s, session: %s, file: %s", rec.taskName, rec.sessionId, rec.path)
+}
+
+// ActiveTasks returns the names of the tasks with an open recording.
+func ActiveTasks() []string {
+	recordingsLock.Lock()
+	defer recordingsLock.Unlock()
+
+	names := make([]string, 0, len(recordings))
+	for taskName := range recordings {
+		names = append(names, taskName)
+	}
+	return names
+}
+
+// attachRecording returns the open recording of the task when the session
+// matches, otherwise it finishes any previous recording and starts a new one.
+func attachRecording(taskName, sessionId string, conn *websocket.Conn) (*recording, bool, error) {
+	recordingsLock.Lock()
+	defer recordingsLock.Unlock()
+
+	if rec, ok := recordings[taskName]; ok {
+		rec.lock.Lock()
+		if sessionId != "" && rec.sessionId == sessionId && !rec.closed {
+			if rec.closeTimer != nil {
+				rec.closeTimer.Stop()
+				rec.closeTimer = nil
+			}
+			if rec.conn != nil {
+				rec.conn.Close()
+			}
+			rec.conn = conn
+			rec.meter = newIngestMeter()
+			rec.lock.Unlock()
+			emit(&Event{TaskName: taskName, Type: EventRecordResumed, Path: rec.path})
+			return rec, true, nil
+		}
+		rec.lock.Unlock()
+
+		delete(recordings, taskName)
+		rec.finish()
+	}
+
+	startTime := time.Now()
+	rec := &recording{
+		taskName:      taskName,
+		sessionId:     sessionId,
+		startTime:     startTime,
+		conn:          conn,
+		meter:         newIngestMeter(),
+		pending:       map[int64]chan *Reply{},
+		live:          newLiveHub(),
+		hls:           hls.NewWriter(taskName),
+		timecodeScale: webm.DefaultTimecodeScale,
+	}
+	if err := rec.openSegment(startTime); err != nil {
+		return nil, false, err
+	}
+	rec.audio = newAudioMeter(rec)
+	recordings[taskName] = rec
+	emit(&Event{TaskName: taskName, Type: EventRecordStarted, Path: rec.path})
+
+	return rec, false, nil
+}
+
+// openSegment creates the file the next clusters are written to. The name
+// has the time in nanoseconds and the session, and an existing file is never
+// reused, so a new session or segment can't append to an older one.
+func (rec *recording) openSegment(now time.Time) error {
+	dirPath := *conf.LocalVideoPath
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s_%d", rec.taskName, now.UnixNano())
+	if session := sessionName(rec.sessionId); session != "" {
+		name += "-" + session
+	}
+	path := filepath.Join(dirPath, name+".webm")
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	rec.path = path
+	rec.fd = fd
+	rec.writer = bufio.NewWriterSize(fd, *conf.WriteBufferSize*1024)
+	rec.lastSync = now
+	rec.segmentStart = now
+	rec.segmentSize = 0
+	rec.segmentHash = sha256.New()
+	if err := writeJournal(rec); err != nil {
+		logrus.WithError(err).Errorf("write recording journal failed. %s", rec.Description())
+	}
+	return nil
+}
+
+// writeRaw writes to the current segment file, hashing what is written.
+func (rec *recording) writeRaw(b []byte) (int, error) {
+	n, err := rec.writer.Write(b)
+	rec.segmentHash.Write(b[:n])
+	rec.segmentSize += int64(n)
+	return n, err
+}
+
+// closeSegment flushes and closes the current file and hands it to the
+// storage backend.
+func (rec *recording) closeSegment(eventType string) {
+	if rec.err == nil {
+		if err := rec.sync(); err != nil {
+			rec.err = err
+			logrus.WithError(err).Errorf("flush recording failed. %s", rec.Description())
+		}
+	}
+	if err := rec.fd.Close(); err != nil {
+		logrus.WithError(err).Errorf("close recording failed. %s", rec.Description())
+	}
+
+	ev := &Event{
+		TaskName: rec.taskName,
+		Type:     eventType,
+		Path:     rec.path,
+		Segment:  rec.segment,
+		Err:      rec.err,
+	}
+	emit(ev)
+
+	duration := time.Duration(rec.lastTimecode-rec.segmentBase) * time.Duration(rec.timecodeScale)
+	if duration < 0 {
+		duration = 0
+	}
+	publishSegment(&catalog.Recording{
+		Id:        segmentId(rec.path),
+		TaskName:  rec.taskName,
+		Url:       getTaskUrl(rec.taskName),
+		SessionId: rec.sessionId,
+		Segment:   rec.segment,
+		StartTime: rec.segmentStart,
+		EndTime:   time.Now(),
+		Duration:  duration.Seconds(),
+		Size:      rec.segmentSize,
+		Codecs:    rec.codecs,
+		Sha256:    hex.EncodeToString(rec.segmentHash.Sum(nil)),
+		Path:      rec.path,
+		Location:  rec.path,
+		State:     catalog.StateFinished,
+	})
+	removeJournal(rec.path)
+}
+
+// sessionName keeps the letters, digits and dashes of the session id sent by
+// the extension, so it can be part of a file name.
+func sessionName(sessionId string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return -1
+	}, sessionId)
+}
+
+func segmentId(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// publishSegment adds a finished segment file to the catalog, generates its
+// thumbnails and hands it to the storage backend.
+func publishSegment(entry *catalog.Recording) {
+	if err := catalog.Add(entry); err != nil {
+		logrus.WithError(err).Errorf("add recording %s to catalog failed", entry.Id)
+	}
+
+	go func() {
+		if thumbnail.Enabled() {
+			addThumbnails(entry)
+		}
+		submitSegment(entry)
+	}()
+}
+
+func addThumbnails(entry *catalog.Recording) {
+	vtt, sprites, err := thumbnail.Generate(entry)
+	if err != nil {
+		logrus.WithError(err).Warnf("no thumbnails of recording %s", entry.Id)
+		return
+	}
+	if vtt == "" {
+		return
+	}
+
+	err = catalog.Update(entry.Id, func(entry *catalog.Recording) {
+		entry.Thumbnails = vtt
+		entry.Sprites = sprites
+	})
+	if err != nil {
+		logrus.WithError(err).Errorf("update recording %s in catalog failed", entry.Id)
+	}
+}
+
+// submitSegment uploads the segment and keeps its location in the catalog.
+func submitSegment(entry *catalog.Recording) {
+	id, taskName, path, segment := entry.Id, entry.TaskName, entry.Path, entry.Segment
+	storage.Submit(&storage.Job{
+		Key:       "recordings/" + filepath.Base(path),
+		LocalPath: path,
+		Metadata: map[string]string{
+			"Task-Name":  taskName,
+			"Session-Id": entry.SessionId,
+			"Segment":    strconv.Itoa(segment),
+			"Start-Time": entry.StartTime.Format(time.RFC3339),
+			"End-Time":   entry.EndTime.Format(time.RFC3339),
+		},
+		OnDone: func(location string, err error) {
+			updateErr := catalog.Update(id, func(entry *catalog.Recording) {
+				if err != nil {
+					entry.State = catalog.StateUploadFailed
+					return
+				}
+				if location != entry.Path {
+					entry.State = catalog.StateUploaded
+				}
+				entry.Location = location
+			})
+			if updateErr != nil {
+				logrus.WithError(updateErr).Errorf("update recording %s in catalog failed", id)
+			}
+
+			emit(&Event{
+				TaskName: taskName,
+				Type:     EventUploaded,
+				Path:     path,
+				Segment:  segment,
+				Location: location,
+				Err:      err,
+			})
+		},
+	})
+}
+
+// rotate starts the next segment with the header of the recording. The
+// timecodes of the new file start again from zero.
+func (rec *recording) rotate() error {
+	rec.closeSegment(EventSegmentFinished)
+	if rec.err != nil {
+		return rec.err
+	}
+
+	rec.segment++
+	if err := rec.openSegment(time.Now()); err != nil {
+		rec.err = err
+		return err
+	}
+	rec.rebase = true
+
+	logrus.Printf("recording rotated to segment %d. %s", rec.segment, rec.Description())
+	if _, err := rec.writeRaw(rec.header); err != nil {
+		rec.err = err
+		return err
+	}
+	return nil
+}
+
+// newStream prepares the parser of a connection attached to the recording.
+func (rec *recording) newStream(conn *websocket.Conn, resumed bool) *stream {
+	s := &stream{
+		rec:     rec,
+		conn:    conn,
+		resumed: resumed,
+		scale:   webm.DefaultTimecodeScale,
+	}
+	s.parser = webm.NewParser(s.onElement)
+
+	// the meter is replaced when the connection is resumed
+	rec.lock.Lock()
+	s.meter = rec.meter
+	rec.lock.Unlock()
+	return s
+}
+
+// detach is called when the connection is gone. The file stays open for the
+// resume timeout unless the connection was already replaced by a new one.
+func (rec *recording) detach(conn *websocket.Conn) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	if rec.conn != conn || rec.closed {
+		return
+	}
+	rec.conn = nil
+
+	if err := rec.sync(); err != nil {
+		rec.err = err
+		go rec.fail(err)
+		return
+	}
+
+	timeout := time.Duration(*conf.ResumeTimeout) * time.Second
+	if rec.sessionId == "" || timeout <= 0 {
+		go rec.release()
+		return
+	}
+
+	logrus.Printf("recording detached, waiting %s for reconnect. %s", timeout, rec.Description())
+	rec.closeTimer = time.AfterFunc(timeout, rec.release)
+}
+
+// release removes the recording from the registry and closes it.
+func (rec *recording) release() {
+	recordingsLock.Lock()
+	if recordings[rec.taskName] == rec {
+		delete(recordings, rec.taskName)
+	}
+	recordingsLock.Unlock()
+
+	rec.finish()
+}
+
+func (rec *recording) finish() {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	if rec.closed {
+		return
+	}
+	rec.closed = true
+
+	if rec.closeTimer != nil {
+		rec.closeTimer.Stop()
+		rec.closeTimer = nil
+	}
+	if rec.conn != nil {
+		rec.conn.Close()
+		rec.conn = nil
+	}
+	rec.closeSegment(EventRecordFinished)
+	rec.live.closeAll()
+	rec.audio.close()
+	rec.hls.Close()
+
+	logrus.Printf("recording finished, duration: %s. %s", time.Since(rec.startTime), rec.Description())
+}
+
+// fail stops the recording after a write error instead of dropping what the
+// extension keeps sending. The task gets an event, the connection is closed
+// with an error code and the extension backs off before reconnecting, which
+// starts a new recording once the disk accepts writes again.
+func (rec *recording) fail(err error) {
+	rec.lock.Lock()
+	if rec.closed {
+		rec.lock.Unlock()
+		return
+	}
+	rec.err = err
+	conn := rec.conn
+	rec.lock.Unlock()
+
+	diskFull := errors.Is(err, syscall.ENOSPC)
+	logrus.WithError(err).Errorf("recording write failed, disk full: %v. %s", diskFull, rec.Description())
+	emit(&Event{TaskName: rec.taskName, Type: EventWriteError, Path: rec.path, Err: err, DiskFull: diskFull})
+
+	if conn != nil {
+		msg := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "recording write failed")
+		rec.writeLock.Lock()
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		rec.writeLock.Unlock()
+	}
+
+	rec.release()
+}
+
+// writeErr returns the error that stopped the recording, if any.
+func (rec *recording) writeErr() error {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	return rec.err
+}
+
+func (rec *recording) write(id uint32, b []byte) error {
+	if err := rec.writeFile(id, b); err != nil {
+		return err
+	}
+
+	rec.forward(id, b)
+	return nil
+}
+
+func (rec *recording) writeFile(id uint32, b []byte) error {
+	if rec.closed {
+		return os.ErrClosed
+	}
+	if rec.err != nil {
+		return rec.err
+	}
+
+	n, err := rec.writeRaw(b)
+	if rec.meter != nil {
+		rec.meter.written(n)
+	}
+	if err != nil {
+		rec.err = err
+		return err
+	}
+
+	if !rec.headerWritten {
+		rec.header = append(rec.header, b...)
+	}
+	return nil
+}
+
+// forward passes a written element to the live viewers, the audio meter and
+// the hls segmenter, which follow the whole recording across segments.
+func (rec *recording) forward(id uint32, b []byte) {
+	rec.live.element(id, b)
+	rec.audio.element(id, b)
+	rec.hls.Write(id, b)
+}
+
+// forwardHeader passes the header of a restarted stream, which is not
+// written as the file keeps the first one, to the live viewers and the audio
+// meter.
+func (rec *recording) forwardHeader(id uint32, b []byte) {
+	rec.live.element(id, b)
+	rec.audio.element(id, b)
+}
+
+// sync flushes the write buffer and fsyncs the file.
+func (rec *recording) sync() error {
+	if err := rec.writer.Flush(); err != nil {
+		return err
+	}
+	rec.lastSync = time.Now()
+	if *conf.FsyncPolicy == "never" {
+		return nil
+	}
+	return rec.fd.Sync()
+}
+
+// commit applies the fsync policy once a message has been written.
+func (rec *recording) commit() error {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	if rec.closed {
+		return nil
+	}
+	if rec.err != nil {
+		return rec.err
+	}
+
+	switch *conf.FsyncPolicy {
+	case "always":
+		return rec.sync()
+	case "interval":
+		if time.Since(rec.lastSync) >= time.Duration(*conf.FsyncInterval)*time.Second {
+			return rec.sync()
+		}
+	}
+	return nil
+}
+
+// onElement writes one parsed element to the recording. Clusters are always
+// rewritten with unknown size so their timecode can be shifted; the headers
+// of a resumed stream are dropped and its clusters continue after the last
+// written block.
+func (s *stream) onElement(el *webm.Element) error {
+	rec := s.rec
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+
+	if rec.conn != s.conn {
+		return errSuperseded
+	}
+
+	switch el.ID {
+	case webm.IDEBML:
+		if rec.headerWritten {
+			// the recorder was restarted on this connection, e.g. to
+			// change the bitrate, so continue it like a reconnect
+			s.resumed = true
+			s.hasOffset = false
+			// its tracks may differ, the live viewers need its header
+			rec.live.restart()
+			rec.audio.restart()
+			rec.forwardHeader(el.ID, webm.AppendElement(nil, el.ID, el.Data))
+			return nil
+		}
+		return rec.write(el.ID, webm.AppendElement(nil, el.ID, el.Data))
+
+	case webm.IDTracks:
+		if rec.headerWritten {
+			rec.forwardHeader(el.ID, webm.AppendElement(nil, el.ID, el.Data))
+			return nil
+		}
+		if tracks, err := webm.ParseTracks(el.Data); err == nil {
+			for _, track := range tracks {
+				if track.CodecID != "" {
+					rec.codecs = append(rec.codecs, track.CodecID)
+				}
+			}
+		}
+		return rec.write(el.ID, webm.AppendElement(nil, el.ID, el.Data))
+
+	case webm.IDTags, webm.IDChapters, webm.IDAttachments:
+		if rec.headerWritten {
+			rec.forwardHeader(el.ID, webm.AppendElement(nil, el.ID, el.Data))
+			return nil
+		}
+		return rec.write(el.ID, webm.AppendElement(nil, el.ID, el.Data))
+
+	case webm.IDSegment:
+		if rec.headerWritten {
+			rec.forwardHeader(el.ID, webm.AppendMasterStart(nil, el.ID))
+			return nil
+		}
+		return rec.write(el.ID, webm.AppendMasterStart(nil, el.ID))
+
+	case webm.IDInfo:
+		s.scale = webm.ParseInfoTimecodeScale(el.Data)
+		if rec.headerWritten {
+			rec.forwardHeader(el.ID, webm.AppendElement(nil, el.ID, el.Data))
+			return nil
+		}
+		rec.timecodeScale = s.scale
+		return rec.write(el.ID, webm.AppendElement(nil, el.ID, el.Data))
+
+	case webm.IDSeekHead, webm.IDCues, webm.IDVoid, webm.IDCRC32:
+		// positions in these no longer match once clusters are rewritten
+		return nil
+
+	case webm.IDCluster:
+		segmentDuration := time.Duration(*conf.SegmentDuration) * time.Second
+		if !rec.headerWritten {
+			rec.headerWritten = true
+		} else if segmentDuration > 0 && time.Since(rec.segmentStart) >= segmentDuration {
+			if err := rec.rotate(); err != nil {
+				return err
+			}
+		}
+		return rec.write(el.ID, webm.AppendMasterStart(nil, el.ID))
+
+	case webm.IDTimecode:
+		if el.Level != 2 {
+			return rec.write(el.ID, webm.AppendElement(nil, el.ID, el.Data))
+		}
+		timecode := int64(webm.ReadUint(el.Data))
+		if s.resumed && !s.hasOffset {
+			s.hasOffset = true
+			gap := int64(1)
+			if !rec.lastWriteTime.IsZero() {
+				gap = int64(time.Since(rec.lastWriteTime)) / int64(rec.timecodeScale)
+			}
+			if gap < 1 {
+				gap = 1
+			}
+			s.offset = rec.lastTimecode + gap - timecode
+			logrus.Printf("recording resumed, timecode offset: %d. %s", s.offset, rec.Description())
+		}
+		s.cluster = timecode + s.offset
+		if s.cluster < 0 {
+			s.cluster = 0
+		}
+		if rec.rebase {
+			rec.rebase = false
+			rec.segmentBase = s.cluster
+		}
+		if err := rec.writeFile(el.ID, webm.AppendUint(nil, el.ID, uint64(s.cluster-rec.segmentBase))); err != nil {
+			return err
+		}
+		rec.forward(el.ID, webm.AppendUint(nil, el.ID, uint64(s.cluster)))
+		return nil
+
+	case webm.IDSimpleBlock, webm.IDBlockGroup:
+		var block *webm.Block
+		var err error
+		if el.ID == webm.IDSimpleBlock {
+			block, err = webm.ParseBlock(el.Data)
+		} else {
+			block, err = webm.ParseBlockGroup(el.Data)
+		}
+		if err == nil {
+			if timecode := s.cluster + int64(block.Timecode); timecode > rec.lastTimecode {
+				rec.lastTimecode = timecode
+			}
+		}
+		rec.lastWriteTime = time.Now()
+		return rec.write(el.ID, webm.AppendElement(nil, el.ID, el.Data))
+
+	default:
+		if el.Level < 2 && rec.headerWritten {
+			return nil
+		}
+		return rec.write(el.ID, webm.AppendElement(nil, el.ID, el.Data))
+	}
+}
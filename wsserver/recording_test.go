@@ -0,0 +1,188 @@
+package wsserver
+
+import (
+	"chrome_render/webm"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// setup keeps the recordings and catalog of a test in its own directory,
+// with no decoder, hls output or segment rotation.
+func setup(t *testing.T) {
+	*conf.LocalVideoPath = t.TempDir()
+	*conf.CatalogPath = filepath.Join(*conf.LocalVideoPath, "catalog.json")
+	*conf.FfmpegPath = "/nonexistent/ffmpeg"
+	*conf.HlsWindow = 0
+	*conf.SegmentDuration = 0
+}
+
+// liveStream is a stream as MediaRecorder writes it, a Segment and Clusters
+// of unknown size with a keyframe at the start of each cluster.
+func liveStream(timecodes ...uint64) []byte {
+	b := webm.AppendElement(nil, webm.IDEBML, webm.AppendElement(nil, 0x4282, []byte("webm")))
+	b = webm.AppendMasterStart(b, webm.IDSegment)
+	b = webm.AppendElement(b, webm.IDInfo, webm.AppendUint(nil, webm.IDTimecodeScale, webm.DefaultTimecodeScale))
+
+	entry := webm.AppendUint(nil, webm.IDTrackNumber, 1)
+	entry = webm.AppendUint(entry, webm.IDTrackType, webm.TrackTypeVideo)
+	entry = webm.AppendElement(entry, webm.IDCodecID, []byte("V_VP8"))
+	b = webm.AppendElement(b, webm.IDTracks, webm.AppendElement(nil, webm.IDTrackEntry, entry))
+
+	for _, timecode := range timecodes {
+		b = webm.AppendMasterStart(b, webm.IDCluster)
+		b = webm.AppendUint(b, webm.IDTimecode, timecode)
+		b = webm.AppendElement(b, webm.IDSimpleBlock, []byte{0x81, 0, 0, 0x80, 'k'})
+		b = webm.AppendElement(b, webm.IDSimpleBlock, []byte{0x81, 0x01, 0xf4, 0, 'd'})
+	}
+	return b
+}
+
+// feed writes stream to s in small chunks, as websocket messages split it.
+func feed(t *testing.T, s *stream, stream []byte) {
+	for len(stream) > 0 {
+		n := 5
+		if n > len(stream) {
+			n = len(stream)
+		}
+		if _, err := s.parser.Write(stream[:n]); err != nil {
+			t.Fatal(err)
+		}
+		stream = stream[n:]
+	}
+}
+
+type written struct {
+	counts    map[uint32]int
+	clusters  []int64
+	sizes     []int64
+	truncated bool
+}
+
+// contents reads the segment file of rec back.
+func contents(t *testing.T, rec *recording) *written {
+	rec.lock.Lock()
+	err := rec.sync()
+	path := rec.path
+	rec.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &written{counts: map[uint32]int{}}
+	p := webm.NewParser(func(el *webm.Element) error {
+		w.counts[el.ID]++
+		switch {
+		case el.ID == webm.IDCluster:
+			w.sizes = append(w.sizes, el.Size)
+		case el.ID == webm.IDTimecode && el.Level == 2:
+			w.clusters = append(w.clusters, int64(webm.ReadUint(el.Data)))
+		}
+		return nil
+	})
+	if _, err := p.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	w.truncated = p.Buffered() > 0
+	return w
+}
+
+func newTestRecording(t *testing.T, taskName string) *recording {
+	setup(t)
+	rec, resumed, err := attachRecording(taskName, "session-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed {
+		t.Fatal("new recording taken as resumed")
+	}
+	t.Cleanup(func() {
+		recordingsLock.Lock()
+		delete(recordings, taskName)
+		recordingsLock.Unlock()
+		rec.fd.Close()
+	})
+	return rec
+}
+
+func TestResumeStream(t *testing.T) {
+	rec := newTestRecording(t, "resume")
+
+	feed(t, rec.newStream(nil, false), liveStream(0, 1000))
+
+	// the extension reconnects and starts a new stream at timecode 0
+	again, resumed, err := attachRecording("resume", "session-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != rec || !resumed {
+		t.Fatal("reconnect of the session not resumed")
+	}
+	s := rec.newStream(nil, true)
+	feed(t, s, liveStream(0, 1000))
+
+	// the recorder restarts on the same connection, e.g. for a new bitrate
+	feed(t, s, liveStream(0))
+
+	w := contents(t, rec)
+	if w.truncated {
+		t.Error("segment ends inside an element")
+	}
+	for _, id := range []uint32{webm.IDEBML, webm.IDSegment, webm.IDInfo, webm.IDTracks} {
+		if w.counts[id] != 1 {
+			t.Errorf("element %x written %d times, want the header once", id, w.counts[id])
+		}
+	}
+	if w.counts[webm.IDSimpleBlock] != 10 {
+		t.Errorf("%d blocks written, want 10", w.counts[webm.IDSimpleBlock])
+	}
+	for n, size := range w.sizes {
+		if size != webm.UnknownSize {
+			t.Errorf("cluster %d written with size %d", n, size)
+		}
+	}
+
+	if len(w.clusters) != 5 {
+		t.Fatalf("clusters at %v, want 5", w.clusters)
+	}
+	if w.clusters[0] != 0 || w.clusters[1] != 1000 {
+		t.Errorf("first stream clusters at %v, want 0 and 1000", w.clusters[:2])
+	}
+	// the last block was at 1500, the resumed stream continues after it
+	// by the time the extension was away
+	if first := w.clusters[2]; first <= 1500 || first > 1500+10000 {
+		t.Errorf("resumed stream starts at %d, want right after 1500", first)
+	}
+	if w.clusters[3]-w.clusters[2] != 1000 {
+		t.Errorf("resumed clusters at %v, want 1000 apart", w.clusters[2:4])
+	}
+	if restarted := w.clusters[4]; restarted <= w.clusters[3]+500 {
+		t.Errorf("restarted stream starts at %d, want after %d", restarted, w.clusters[3]+500)
+	}
+}
+
+func TestNewSessionStartsNewSegment(t *testing.T) {
+	rec := newTestRecording(t, "session")
+	feed(t, rec.newStream(nil, false), liveStream(0))
+
+	other, resumed, err := attachRecording("session", "session-2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		recordingsLock.Lock()
+		delete(recordings, "session")
+		recordingsLock.Unlock()
+		other.fd.Close()
+	})
+	if resumed || other == rec {
+		t.Fatal("a new session resumed the recording of the previous one")
+	}
+	if other.path == rec.path {
+		t.Errorf("new session reopened %s", rec.path)
+	}
+}
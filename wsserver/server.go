@@ -1,12 +1,10 @@
 package wsserver
 
 import (
-	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
-	"log"
+	"io"
 	"net/http"
-	"os"
 	"time"
 )
 
@@ -16,28 +14,117 @@ var upgrader = websocket.Upgrader{
 	},
 } // use default options
 
+// echo receives the webm stream of the extension as binary messages and its
+// acks and stats as JSON text messages. The task and session query
+// parameters identify the recording, so a reconnect of the same session
+// continues the file the previous connection was writing.
 func echo(w http.ResponseWriter, r *http.Request) {
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Print("upgrade:", err)
+		logrus.WithError(err).Errorln("upgrade failed")
 		return
 	}
 	defer c.Close()
-	fd,_:=os.OpenFile(fmt.Sprintf("%d.webm", time.Now().Unix()),os.O_RDWR|os.O_CREATE|os.O_APPEND,0644)
+	c.SetReadLimit(int64(*conf.MaxMessageSize) << 20)
+
+	taskName := r.URL.Query().Get("task")
+	if taskName == "" {
+		taskName = "default"
+	}
+	sessionId := r.URL.Query().Get("session")
+
+	rec, resumed, err := attachRecording(taskName, sessionId, c)
+	if err != nil {
+		logrus.WithError(err).Errorf("open recording failed. task name: %s", taskName)
+		return
+	}
+	defer rec.detach(c)
+
+	if resumed {
+		logrus.Printf("extension reconnected. %s", rec.Description())
+	} else {
+		logrus.Printf("new recording. %s", rec.Description())
+		go func() {
+			if err := rec.sendCommand(ActionStart, getCaptureOptions(taskName)); err != nil {
+				logrus.WithError(err).Errorf("start extension recorder failed. %s", rec.Description())
+			}
+		}()
+	}
+
+	s := rec.newStream(c, resumed)
 	for {
 		mt, message, err := c.ReadMessage()
 		if err != nil {
-			log.Println("read:", err)
-			fd.Close()
-			break
+			logrus.WithError(err).Printf("read failed. %s", rec.Description())
+			return
+		}
+
+		logrus.Debugf("recv type: %d, data len: %d", mt, len(message))
+		delay := s.meter.received(len(message))
+
+		if mt == websocket.TextMessage {
+			rec.onTextMessage(message)
+		} else if _, err := s.parser.Write(message); err == errSuperseded {
+			return
+		} else if err != nil {
+			if rec.writeErr() == nil {
+				logrus.WithError(err).Errorf("parse recording stream failed. %s", rec.Description())
+				return
+			}
+			rec.fail(err)
+			return
+		} else if err := rec.commit(); err != nil {
+			rec.fail(err)
+			return
 		}
 
-		log.Printf("recv type: %d, data len: %d", mt,  len( message))
-		fd.Write(message)
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+}
+
+// Ingest records a webm stream produced in this process, like the output of
+// the screencast encoder, the same way as the stream of an extension. It
+// returns when r ends or the recording is taken over by a connection of the
+// extension.
+func Ingest(taskName string, r io.Reader) error {
+	rec, _, err := attachRecording(taskName, "", nil)
+	if err != nil {
+		return err
+	}
+	defer rec.detach(nil)
+	logrus.Printf("new local recording. %s", rec.Description())
+
+	s := rec.newStream(nil, false)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := s.parser.Write(buf[:n]); err == errSuperseded {
+				return nil
+			} else if err != nil {
+				if rec.writeErr() == nil {
+					return err
+				}
+				rec.fail(err)
+				return err
+			} else if err := rec.commit(); err != nil {
+				rec.fail(err)
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 	}
 }
 
 func Start() {
 	http.HandleFunc("/", echo)
-	logrus.Fatal(http.ListenAndServe("localhost:8080", nil))
-}
\ No newline at end of file
+	http.HandleFunc("/live", live)
+	logrus.Fatal(http.ListenAndServe(*conf.IngestAddr, nil))
+}
@@ -0,0 +1,334 @@
+package wsserver
+
+import (
+	"bufio"
+	"chrome_render/webm"
+	"encoding/binary"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"math"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	decodeSampleRate = 8000
+	decodeQueueSize  = 512
+
+	// Opus and Vorbis packets of digital silence are a few bytes each, so
+	// without a decoder a very low audio bitrate is taken as silence.
+	silentBytesPerSecond = 400
+)
+
+// AudioLevel is the loudness gauge of a recording.
+type AudioLevel struct {
+	Level      float64 // dBFS of the last second, 0 when Estimated
+	BitRate    int     // audio payload rate of the last second, b/s
+	Silent     bool
+	SilentFor  int // seconds
+	Estimated  bool
+	UpdateTime time.Time
+}
+
+// audioMeter measures the audio track written to a recording once per
+// second. The audio is decoded by ffmpeg when it can be found, otherwise
+// silence is estimated from the size of the encoded packets.
+type audioMeter struct {
+	lock sync.Mutex
+
+	rec        *recording
+	path       string
+	init       []byte
+	initDone   bool
+	audioTrack uint64
+	codec      string
+	scale      uint64
+
+	clusterTimecode int64
+	second          int64
+	secondBytes     int
+
+	decoder *exec.Cmd
+	chData  chan []byte
+	dropped bool
+
+	level   AudioLevel
+	alerted bool
+}
+
+func newAudioMeter(rec *recording) *audioMeter {
+	return &audioMeter{
+		rec:    rec,
+		path:   rec.path,
+		scale:  webm.DefaultTimecodeScale,
+		second: -1,
+	}
+}
+
+// description is the part of the recording description that doesn't change
+// with the segment, the meter runs outside of the recording lock.
+func (m *audioMeter) description() string {
+	return fmt.Sprintf("task name: %s, session: %s", m.rec.taskName, m.rec.sessionId)
+}
+
+// element is called with every element written to the recording, under the
+// recording lock, so it keeps the path of the current segment for events
+// sent later by the decoder.
+func (m *audioMeter) element(id uint32, b []byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.path = m.rec.path
+
+	_, _, n, err := webm.ReadElementHeader(b)
+	if err != nil || n == 0 {
+		return
+	}
+	data := b[n:]
+
+	if !m.initDone {
+		switch id {
+		case webm.IDInfo:
+			m.scale = webm.ParseInfoTimecodeScale(data)
+		case webm.IDTracks:
+			if tracks, err := webm.ParseTracks(data); err == nil {
+				if track, ok := webm.FindTrack(tracks, webm.TrackTypeAudio); ok {
+					m.audioTrack = track.Number
+					m.codec = track.CodecID
+				}
+			}
+		case webm.IDCluster:
+			m.initDone = true
+			m.startDecoder()
+		}
+		if !m.initDone {
+			m.init = append(m.init, b...)
+			return
+		}
+	}
+
+	if m.audioTrack == 0 {
+		return
+	}
+
+	switch id {
+	case webm.IDCluster:
+		m.feed(id, b)
+	case webm.IDTimecode:
+		m.clusterTimecode = int64(webm.ReadUint(data))
+		m.feed(id, b)
+	case webm.IDSimpleBlock:
+		block, err := webm.ParseBlock(data)
+		if err != nil || block.Track != m.audioTrack {
+			return
+		}
+		m.feed(id, b)
+		timecode := m.clusterTimecode + int64(block.Timecode)
+		m.account(timecode*int64(m.scale)/int64(time.Second), len(block.Payload))
+	}
+}
+
+// startDecoder runs ffmpeg to turn the audio into 8kHz mono PCM.
+func (m *audioMeter) startDecoder() {
+	if m.audioTrack == 0 {
+		logrus.Warnf("recording has no audio track. %s", m.description())
+		return
+	}
+
+	path, err := exec.LookPath(*conf.FfmpegPath)
+	if err != nil {
+		logrus.WithError(err).Warnf("ffmpeg not found, estimating silence from %s packets. %s", m.codec, m.description())
+		return
+	}
+
+	cmd := exec.Command(path, "-hide_banner", "-loglevel", "error",
+		"-f", "webm", "-i", "pipe:0",
+		"-vn", "-ac", "1", "-ar", "8000", "-f", "s16le", "pipe:1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		logrus.WithError(err).Errorf("start audio decoder failed. %s", m.description())
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		logrus.WithError(err).Errorf("start audio decoder failed. %s", m.description())
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		logrus.WithError(err).Errorf("start audio decoder failed. %s", m.description())
+		return
+	}
+
+	m.decoder = cmd
+	m.chData = make(chan []byte, decodeQueueSize)
+	m.chData <- m.init
+
+	go m.writeLoop(stdin, m.chData)
+	go m.readLoop(stdout, cmd)
+}
+
+// feed queues b for the decoder rather than blocking the recording. When
+// ffmpeg falls behind the rest of the cluster is dropped and the decoder
+// gets the stream again from the start of the next one, which it can read
+// as the clusters have an unknown size.
+func (m *audioMeter) feed(id uint32, b []byte) {
+	if m.chData == nil || m.dropped && id != webm.IDCluster {
+		return
+	}
+
+	select {
+	case m.chData <- b:
+		if m.dropped {
+			m.dropped = false
+			logrus.Debugf("audio decoder resumed at a cluster. %s", m.description())
+		}
+	default:
+		if !m.dropped {
+			m.dropped = true
+			logrus.Debugf("audio decoder queue is full, skipping to the next cluster. %s", m.description())
+		}
+	}
+}
+
+// restart stops the decoder when the recorder starts a new stream, its
+// header may differ, e.g. a new codec private. The header that follows
+// starts a new decoder at the first cluster.
+func (m *audioMeter) restart() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.chData != nil {
+		close(m.chData)
+		m.chData = nil
+	}
+	m.decoder = nil
+	m.dropped = false
+	m.init = nil
+	m.initDone = false
+	m.audioTrack = 0
+	m.codec = ""
+	m.scale = webm.DefaultTimecodeScale
+	m.clusterTimecode = 0
+	m.second = -1
+	m.secondBytes = 0
+}
+
+func (m *audioMeter) writeLoop(w io.WriteCloser, chData chan []byte) {
+	defer w.Close()
+
+	for b := range chData {
+		if _, err := w.Write(b); err != nil {
+			logrus.WithError(err).Warnf("write audio decoder failed. %s", m.description())
+			for range chData {
+			}
+			return
+		}
+	}
+}
+
+func (m *audioMeter) readLoop(r io.Reader, decoder *exec.Cmd) {
+	reader := bufio.NewReader(r)
+	samples := make([]int16, decodeSampleRate)
+
+	for {
+		if err := binary.Read(reader, binary.LittleEndian, samples); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				logrus.WithError(err).Warnf("read audio decoder failed. %s", m.description())
+			}
+			break
+		}
+
+		var sum float64
+		for _, s := range samples {
+			v := float64(s) / math.MaxInt16
+			sum += v * v
+		}
+		level := -120.0
+		if rms := math.Sqrt(sum / float64(len(samples))); rms > 0 {
+			level = math.Max(20*math.Log10(rms), level)
+		}
+
+		m.lock.Lock()
+		m.level.Level = level
+		m.level.Estimated = false
+		m.update(level < float64(*conf.SilenceThreshold))
+		m.lock.Unlock()
+	}
+
+	if err := decoder.Wait(); err != nil {
+		logrus.WithError(err).Warnf("audio decoder exited. %s", m.description())
+	}
+}
+
+// account adds an encoded audio packet to the second it belongs to, which
+// gives the bitrate and, without a decoder, the silence estimate.
+func (m *audioMeter) account(second int64, size int) {
+	if m.second < 0 || second > m.second+60 {
+		// first packet or the timecodes jumped, e.g. after a resume
+		m.second = second
+	}
+
+	for m.second < second {
+		m.level.BitRate = m.secondBytes * 8
+		if m.decoder == nil {
+			m.level.Estimated = true
+			m.update(m.secondBytes < silentBytesPerSecond)
+		}
+		m.secondBytes = 0
+		m.second++
+	}
+	m.secondBytes += size
+}
+
+// update records one more measured second and alerts the task when the
+// silence lasts longer than the configured limit.
+func (m *audioMeter) update(silent bool) {
+	m.level.UpdateTime = time.Now()
+	m.level.Silent = silent
+
+	if !silent {
+		if m.alerted {
+			logrus.Printf("audio restored after %d silent seconds. %s", m.level.SilentFor, m.description())
+			emit(&Event{TaskName: m.rec.taskName, Type: EventSoundRestored, Path: m.path})
+		}
+		m.level.SilentFor = 0
+		m.alerted = false
+		return
+	}
+
+	m.level.SilentFor++
+	if !m.alerted && m.level.SilentFor >= *conf.SilenceAlert {
+		m.alerted = true
+		logrus.Warnf("audio silent for %d seconds. %s", m.level.SilentFor, m.description())
+		emit(&Event{TaskName: m.rec.taskName, Type: EventSilence, Path: m.path, SilentFor: m.level.SilentFor})
+	}
+}
+
+func (m *audioMeter) close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.chData != nil {
+		close(m.chData)
+		m.chData = nil
+	}
+}
+
+// GetAudioLevel returns the loudness gauge of the recording of the task.
+func GetAudioLevel(taskName string) (*AudioLevel, bool) {
+	rec := getRecording(taskName)
+	if rec == nil {
+		return nil, false
+	}
+
+	rec.audio.lock.Lock()
+	defer rec.audio.lock.Unlock()
+
+	if rec.audio.level.UpdateTime.IsZero() {
+		return nil, false
+	}
+	level := rec.audio.level
+	return &level, true
+}
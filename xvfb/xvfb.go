@@ -0,0 +1,216 @@
+package xvfb
+
+import (
+	"chrome_render/cgroup"
+	"chrome_render/config"
+	"chrome_render/reaper"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	maxDisplays  = 1000
+	readyTimeout = 10 * time.Second
+	restartDelay = time.Second
+)
+
+var conf = config.GetConfig()
+
+var (
+	ErrNoDisplay = errors.New("no free x display number")
+	ErrNotReady  = errors.New("xvfb did not start")
+)
+
+var (
+	allocatedLock sync.Mutex
+	allocated     = map[int]bool{}
+)
+
+// Display is an Xvfb server owned by one task. It is restarted when it
+// exits until Stop is called.
+type Display struct {
+	lock sync.Mutex
+
+	Number int
+	width  int
+	height int
+	group  *cgroup.Group
+	cmd    *exec.Cmd
+	exited chan struct{}
+	stop   bool
+}
+
+// Start allocates a free display number and runs an Xvfb of the size, in
+// the cgroup when there is one, restarts included.
+func Start(width, height int, group *cgroup.Group) (*Display, error) {
+	number, err := allocate()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Display{Number: number, width: width, height: height, group: group}
+	if err := d.run(); err != nil {
+		// stops the supervisor and waits for the exit before the number
+		// is released
+		d.Stop()
+		return nil, err
+	}
+
+	logrus.Printf("xvfb started on %s, %dx%d", d.Name(), width, height)
+	return d, nil
+}
+
+// Name is the DISPLAY value of the display.
+func (d *Display) Name() string {
+	return fmt.Sprintf(":%d", d.Number)
+}
+
+// Env is the environment variable passed to the programs using the display.
+func (d *Display) Env() string {
+	return "DISPLAY=" + d.Name()
+}
+
+// Pid returns the process id of the running Xvfb, 0 while it restarts.
+func (d *Display) Pid() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.cmd == nil || d.cmd.Process == nil {
+		return 0
+	}
+	select {
+	case <-d.exited:
+		return 0
+	default:
+		return d.cmd.Process.Pid
+	}
+}
+
+// Stop terminates the Xvfb and releases its display number.
+func (d *Display) Stop() {
+	d.lock.Lock()
+	if d.stop {
+		d.lock.Unlock()
+		return
+	}
+	d.stop = true
+	cmd, exited := d.cmd, d.exited
+	d.lock.Unlock()
+
+	if cmd != nil && cmd.Process != nil {
+		cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			cmd.Process.Kill()
+			<-exited
+		}
+	}
+
+	release(d.Number)
+	logrus.Printf("xvfb on %s stopped", d.Name())
+}
+
+// run starts Xvfb and waits for its socket.
+func (d *Display) run() error {
+	cmd := d.group.Command(*conf.XvfbPath, d.Name(),
+		"-screen", "0", fmt.Sprintf("%dx%dx%d", d.width, d.height, *conf.XvfbDepth),
+		"-nolisten", "tcp", "-noreset")
+
+	d.lock.Lock()
+	if d.stop {
+		d.lock.Unlock()
+		return ErrNotReady
+	}
+	if err := cmd.Start(); err != nil {
+		d.lock.Unlock()
+		return err
+	}
+	exited := make(chan struct{})
+	d.cmd = cmd
+	d.exited = exited
+	d.lock.Unlock()
+
+	if _, err := reaper.Track("xvfb", d.Name(), cmd.Process.Pid); err != nil {
+		logrus.WithError(err).Warnf("track xvfb on %s failed", d.Name())
+	}
+
+	go d.supervise(cmd, exited)
+
+	deadline := time.Now().Add(readyTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(socketPath(d.Number)); err == nil {
+			return nil
+		}
+		select {
+		case <-exited:
+			return ErrNotReady
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	cmd.Process.Kill()
+	return ErrNotReady
+}
+
+// supervise waits for Xvfb to exit and starts it again unless it was
+// stopped.
+func (d *Display) supervise(cmd *exec.Cmd, exited chan struct{}) {
+	err := cmd.Wait()
+	reaper.Untrack("xvfb", cmd.Process.Pid)
+	close(exited)
+
+	d.lock.Lock()
+	stop := d.stop
+	d.lock.Unlock()
+	if stop {
+		return
+	}
+
+	logrus.WithError(err).Errorf("xvfb on %s exited, restarting", d.Name())
+	time.Sleep(restartDelay)
+	if err := d.run(); err != nil {
+		logrus.WithError(err).Errorf("restart xvfb on %s failed", d.Name())
+	}
+}
+
+// allocate picks the first display number from the configured base that
+// is neither used by this process nor by another X server.
+func allocate() (int, error) {
+	allocatedLock.Lock()
+	defer allocatedLock.Unlock()
+
+	for number := *conf.DisplayBase; number < *conf.DisplayBase+maxDisplays; number++ {
+		if allocated[number] || exists(lockPath(number)) || exists(socketPath(number)) {
+			continue
+		}
+		allocated[number] = true
+		return number, nil
+	}
+	return 0, ErrNoDisplay
+}
+
+func release(number int) {
+	allocatedLock.Lock()
+	defer allocatedLock.Unlock()
+
+	delete(allocated, number)
+}
+
+func lockPath(number int) string {
+	return fmt.Sprintf("/tmp/.X%d-lock", number)
+}
+
+func socketPath(number int) string {
+	return fmt.Sprintf("/tmp/.X11-unix/X%d", number)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}